@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// Build is the record of one publish run, whatever started it.
+type Build struct {
+	Id         int            `db:"id" json:"id"`
+	Site       int            `db:"site" json:"site"`
+	Status     string         `db:"status" json:"status"`
+	Log        string         `db:"log" json:"log"`
+	Files      int            `db:"files" json:"files"`
+	Bytes      int64          `db:"bytes" json:"bytes"`
+	Sources    types.JSONText `db:"sources" json:"sources"` // a SourceStatus for each source
+	Live       bool           `db:"live" json:"live"`
+	StartedAt  time.Time      `db:"started_at" json:"started_at"`
+	FinishedAt *time.Time     `db:"finished_at" json:"finished_at"`
+}
+
+func startBuild(pg *sqlx.DB, siteId int) (buildId int, err error) {
+	err = pg.Get(&buildId, `
+INSERT INTO site_builds (site) VALUES ($1)
+RETURNING id
+    `, siteId)
+	return
+}
+
+func finishBuild(pg *sqlx.DB, buildId int, buildErr error, output string, result UploadResult, sources []SourceStatus) error {
+	status := "succeeded"
+	if buildErr != nil {
+		status = "failed"
+	}
+	if sources == nil {
+		sources = []SourceStatus{}
+	}
+	sourcesJSON, err := json.Marshal(sources)
+	if err != nil {
+		return err
+	}
+
+	_, err = pg.Exec(`
+UPDATE site_builds
+SET status = $2, log = $3, files = $4, bytes = $5, sources = $6, finished_at = now()
+WHERE id = $1
+    `, buildId, status, output, result.Added+result.Changed, result.Bytes, sourcesJSON)
+	return err
+}
+
+func setLiveBuild(pg *sqlx.DB, siteId, buildId int) error {
+	_, err := pg.Exec(`
+UPDATE sites SET live_build = $2 WHERE id = $1
+    `, siteId, buildId)
+	return err
+}
+
+// fetchSucceededBuild checks that a build of the site finished well, so
+// its version can be served again.
+func fetchSucceededBuild(pg *sqlx.DB, siteId, buildId int) (build Build, err error) {
+	err = pg.Get(&build, `
+SELECT id, site, status, log, files, bytes, sources, false AS live,
+  started_at, finished_at
+FROM site_builds
+WHERE site = $1 AND id = $2 AND status = 'succeeded'
+    `, siteId, buildId)
+	return
+}
+
+func listBuilds(pg *sqlx.DB, user string, siteId int) (builds []Build, err error) {
+	err = pg.Select(&builds, `
+SELECT
+  site_builds.id, site_builds.site, site_builds.status, site_builds.log,
+  site_builds.files, site_builds.bytes, site_builds.sources,
+  coalesce(sites.live_build = site_builds.id, false) AS live,
+  site_builds.started_at, site_builds.finished_at
+FROM site_builds
+INNER JOIN sites ON sites.id = site_builds.site
+WHERE sites.owner = $1 AND sites.id = $2
+ORDER BY site_builds.id DESC
+LIMIT 50
+    `, user, siteId)
+	return
+}
+
+// logproxy sends everything written to it to the websocket, if there is
+// one, and keeps a copy to be saved with the build.
+type logproxy struct {
+	sync.Mutex
+	conn *wsconn
+	buf  bytes.Buffer
+}
+
+func (l *logproxy) Write(p []byte) (n int, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.buf.Write(p)
+	if l.conn != nil {
+		l.conn.Send(p)
+	}
+	return len(p), nil
+}
+
+// Print sends a single status message.
+func (l *logproxy) Print(message string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.buf.WriteString(message + "\n")
+	if l.conn != nil {
+		l.conn.Send([]byte(message))
+	}
+}
+
+func (l *logproxy) String() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.buf.String()
+}
@@ -44,6 +44,7 @@ type Msg
 type ResponseMsg
   = GotIdentity String
   | GotCreatedSite Int
+  | GotDomainClaim DomainClaim
   | GotSitesList (List Site)
   | GotSite Site
   | GotDeletedSite Int ()
@@ -95,8 +96,13 @@ update msg model =
         { defaultRequest
           | url = "/create-site"
           , body = Http.jsonBody (E.object [ ("domain", E.string domain) ])
-          , expect = Http.expectJson D.int
-        } |> Http.send (handleResponse GotCreatedSite)
+          , expect = Http.expectJson
+            ( D.oneOf
+              [ D.map GotCreatedSite D.int
+              , D.map GotDomainClaim domainClaimDecoder
+              ]
+            )
+        } |> Http.send (handleResponse identity)
     updateSiteData siteId data =
       Http.request
         { defaultRequest
@@ -205,6 +211,17 @@ update msg model =
             , listSites
             ]
           )
+        GotDomainClaim claim ->
+          ( { model
+              | site = Just { emptySite | domain = claim.domain }
+              , log =
+                ( "To create " ++ claim.domain ++ " add a TXT record at "
+                  ++ claim.txtName ++ " with the value " ++ claim.txtExpected
+                  ++ ", then create it again."
+                ) :: model.log
+            }
+          , Cmd.none
+          )
         GotDeletedSite id _ ->
           ( { model
               | log = ("Site " ++ toString id ++ " was deleted successfully.") :: model.log
@@ -35,6 +35,17 @@ type alias SiteData =
 
 emptySiteData = SiteData "" "" "" "" Array.empty "" "" Array.empty False
 
+type alias DomainClaim =
+  { domain : String
+  , txtName : String
+  , txtExpected : String
+  }
+
+domainClaimDecoder = D.map3 DomainClaim
+  (D.field "domain" D.string)
+  (D.at ["txt", "name"] D.string)
+  (D.at ["txt", "expected"] D.string)
+
 siteDecoder = D.map4 Site
   (D.field "id" D.int)
   (D.field "domain" D.string)
@@ -1,50 +1,131 @@
 package main
 
 import (
-	"os"
+	"errors"
 	"strings"
+	"sync"
 
 	"github.com/cloudflare/cloudflare-go"
 )
 
-var cf, _ = cloudflare.New(
-	os.Getenv("CLOUDFLARE_KEY"),
-	os.Getenv("CLOUDFLARE_EMAIL"),
-)
+// cloudflareDNS manages the records of a Cloudflare zone. the zone id is
+// looked up the first time it is needed and again if that fails. without a
+// client, as when the credentials are missing, every method fails with
+// the reason we couldn't have one.
+type cloudflareDNS struct {
+	api    *cloudflare.API
+	apiErr error
+	zone   string
+	mu     sync.Mutex
+	zoneId string
+}
 
-var zoneId, _ = cf.ZoneIDByName(mainHostname)
+func newCloudflareDNS(key, email, zone string) *cloudflareDNS {
+	api, err := cloudflare.New(key, email)
+	if err != nil {
+		log.Warn().Err(err).Msg("couldn't create cloudflare client")
+		return &cloudflareDNS{apiErr: err, zone: zone}
+	}
+	return &cloudflareDNS{api: api, zone: zone}
+}
 
-func setupSubdomainDNS(subdomain string) error {
-	log.Debug().Str("CNAME", subdomain).Msg("setting record on cloudflare.")
-	_, err := cf.CreateDNSRecord(zoneId, cloudflare.DNSRecord{
-		Type:    "CNAME",
-		Name:    subdomain,
-		Content: "s3-website-us-east-1.amazonaws.com",
-		Proxied: true,
+// getZoneId is called first by every method, so it is also where we check
+// there is a client.
+func (c *cloudflareDNS) getZoneId() (string, error) {
+	if c.apiErr != nil {
+		return "", errors.New("no cloudflare client: " + c.apiErr.Error())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.zoneId != "" {
+		return c.zoneId, nil
+	}
+
+	zoneId, err := c.api.ZoneIDByName(c.zone)
+	if err != nil {
+		return "", err
+	}
+	c.zoneId = zoneId
+	return zoneId, nil
+}
+
+func (c *cloudflareDNS) EnsureRecord(record DNSRecord) error {
+	zoneId, err := c.getZoneId()
+	if err != nil {
+		return err
+	}
+
+	recs, err := c.api.DNSRecords(zoneId, cloudflare.DNSRecord{
+		Type: record.Type,
+		Name: record.Name,
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "already exists") {
+		return err
+	}
+
+	rec := cloudflare.DNSRecord{
+		Type:    record.Type,
+		Name:    record.Name,
+		Content: record.Content,
+		Proxied: record.Proxied,
+	}
+	if len(recs) == 0 {
+		_, err = c.api.CreateDNSRecord(zoneId, rec)
+		if err != nil && strings.Contains(err.Error(), "already exists") {
 			return nil
 		}
 		return err
 	}
 
-	return nil
+	existing := recs[0]
+	if existing.Content == record.Content && existing.Proxied == record.Proxied {
+		return nil
+	}
+	return c.api.UpdateDNSRecord(zoneId, existing.ID, rec)
 }
 
-func removeSubdomainDNS(domain string) error {
-	log.Debug().Str("domain", domain).Msg("removing record from cloudflare.")
-	recs, err := cf.DNSRecords(zoneId, cloudflare.DNSRecord{
-		Name: domain,
+func (c *cloudflareDNS) RemoveRecord(name string) error {
+	zoneId, err := c.getZoneId()
+	if err != nil {
+		return err
+	}
+
+	recs, err := c.api.DNSRecords(zoneId, cloudflare.DNSRecord{
+		Name: name,
 	})
 	if err != nil {
 		return err
 	}
 
-	if len(recs) == 0 {
-		return nil
+	for _, rec := range recs {
+		err = c.api.DeleteDNSRecord(zoneId, rec.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cloudflareDNS) ListRecords() ([]DNSRecord, error) {
+	zoneId, err := c.getZoneId()
+	if err != nil {
+		return nil, err
 	}
 
-	rec := recs[0]
-	return cf.DeleteDNSRecord(zoneId, rec.ID)
+	recs, err := c.api.DNSRecords(zoneId, cloudflare.DNSRecord{})
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]DNSRecord, len(recs))
+	for i, rec := range recs {
+		records[i] = DNSRecord{
+			Type:    rec.Type,
+			Name:    rec.Name,
+			Content: rec.Content,
+			Proxied: rec.Proxied,
+		}
+	}
+	return records, nil
 }
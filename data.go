@@ -1,23 +1,46 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+
 	"github.com/fiatjaf/accountd"
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
 )
 
 type Site struct {
-	Id      int            `db:"id" json:"id"`
-	Domain  string         `db:"domain" json:"domain"`
-	Data    types.JSONText `db:"data" json:"data"`
-	Sources types.JSONText `db:"sources" json:"sources"`
+	Id           int            `db:"id" json:"id"`
+	Domain       string         `db:"domain" json:"domain"`
+	Data         types.JSONText `db:"data" json:"data"`
+	Sources      types.JSONText `db:"sources" json:"sources"`
+	Generator    string         `db:"generator" json:"generator"`
+	PublishEvery *int           `db:"publish_every" json:"publish_every"`
+
+	DomainVerified bool `db:"domain_verified" json:"domain_verified"`
 }
 
 type Source struct {
-	Id       int            `json:"id"`
-	Provider string         `json:"provider"`
-	Root     string         `json:"root"`
-	Data     types.JSONText `json:"data"`
+	Id       int            `db:"id" json:"id"`
+	Provider string         `db:"provider" json:"provider"`
+	Root     string         `db:"root" json:"root"`
+	Data     types.JSONText `db:"data" json:"data"`
+	Position int            `db:"position" json:"position"`
+
+	// when updating, nil leaves the source as it was
+	Enabled *bool `db:"enabled" json:"enabled"`
+
+	// what to do when it fails while publishing, see failures.go. when
+	// updating, empty leaves the source as it was.
+	OnError string `db:"on_error" json:"on_error"`
+
+	// set by generateSite, for the providers that need to know
+	Site int `db:"-" json:"-"`
+}
+
+func (source Source) disabled() bool {
+	return source.Enabled != nil && !*source.Enabled
 }
 
 func rewriteAccounts(pg *sqlx.DB, tokendata accountd.TokenData) (n int, err error) {
@@ -46,19 +69,63 @@ WHERE owner = $1
 	return
 }
 
+// ErrDomainTaken is returned when creating a site with a domain that
+// already belongs to another site.
+var ErrDomainTaken = errors.New("this domain is already taken")
+
+// createSite should only be called by claimDomain, which checks custom
+// domains are owned by the user.
 func createSite(pg *sqlx.DB, user, domain string) (id int, err error) {
-	err = pg.Get(&id, `
+	tx, err := pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	used, err := domainInUse(tx, domain, 0)
+	if err != nil {
+		return
+	}
+	if used {
+		err = ErrDomainTaken
+		return
+	}
+
+	err = tx.Get(&id, `
 INSERT INTO sites (owner, domain) VALUES ($1, $2)
 ON CONFLICT (domain) DO NOTHING
 RETURNING id
     `, user, domain)
+	if err == sql.ErrNoRows {
+		err = ErrDomainTaken
+	}
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// domainInUse tells if something other than a site is served at domain:
+// the redirects of sites, except those of the site siteId, and previews.
+// their targets would be taken over by a site created there.
+func domainInUse(tx *sqlx.Tx, domain string, siteId int) (used bool, err error) {
+	err = tx.Get(&used, `
+SELECT exists (SELECT 1 FROM site_redirects WHERE domain = $1 AND site != $2)
+    OR exists (SELECT 1 FROM previews WHERE domain = $1)
+    `, domain, siteId)
 	return
 }
 
 func deleteSite(pg *sqlx.DB, user string, id int) (err error) {
 	_, err = pg.Exec(`
 WITH tsite AS ( SELECT id FROM sites WHERE owner = $1 AND id = $2 ),
-     sdel AS ( DELETE FROM sources WHERE site = (SELECT id FROM tsite) )
+     sdel AS ( DELETE FROM sources WHERE site = (SELECT id FROM tsite) ),
+     jdel AS ( DELETE FROM publish_jobs WHERE site = (SELECT id FROM tsite) ),
+     bdel AS ( DELETE FROM site_builds WHERE site = (SELECT id FROM tsite) ),
+     udel AS ( DELETE FROM uploads WHERE site = (SELECT id FROM tsite) ),
+     rdel AS ( DELETE FROM site_redirects WHERE site = (SELECT id FROM tsite) )
 DELETE FROM sites WHERE id = (SELECT id FROM tsite)
     `, user, id)
 	return
@@ -67,10 +134,13 @@ DELETE FROM sites WHERE id = (SELECT id FROM tsite)
 func fetchSite(pg *sqlx.DB, user string, id int) (site Site, err error) {
 	err = pg.Get(&site, `
 SELECT 
-  id, domain, data,
-  ( SELECT coalesce(json_agg(row_to_json(source)), '[]'::json)
+  id, domain, data, generator, publish_every, domain_verified,
+  ( SELECT coalesce(
+      json_agg(row_to_json(source) ORDER BY source.position, source.id),
+      '[]'::json
+    )
     FROM (
-      SELECT id, provider, root, data
+      SELECT id, provider, root, data, position, enabled, on_error
       FROM sources WHERE sources.site = sites.id
     )source
   ) AS sources
@@ -90,10 +160,37 @@ WHERE owner = $1 AND id = $2
 	return fetchSite(pg, user, siteId)
 }
 
+func updateSiteGenerator(pg *sqlx.DB, user string, siteId int, generator string) (site Site, err error) {
+	_, err = pg.Exec(`
+UPDATE sites SET generator = $3
+WHERE owner = $1 AND id = $2
+    `, user, siteId, generator)
+	if err != nil {
+		return
+	}
+	return fetchSite(pg, user, siteId)
+}
+
+func updateSiteSchedule(pg *sqlx.DB, user string, siteId int, every *int) (site Site, err error) {
+	_, err = pg.Exec(`
+UPDATE sites
+SET publish_every = $3,
+    next_publish_at = now() + make_interval(mins => $3) * random()
+WHERE owner = $1 AND id = $2
+    `, user, siteId, every)
+	if err != nil {
+		return
+	}
+	return fetchSite(pg, user, siteId)
+}
+
 func addSource(pg *sqlx.DB, user string, siteId int) (site Site, err error) {
 	_, err = pg.Exec(`
-INSERT INTO sources (site, provider, root)
-SELECT sites.id, '', '' FROM sites WHERE owner = $1 AND id = $2
+INSERT INTO sources (site, provider, root, position)
+SELECT sites.id, '', '', (
+  SELECT coalesce(max(position), 0) + 1 FROM sources WHERE site = sites.id
+)
+FROM sites WHERE owner = $1 AND id = $2
     `, user, siteId)
 	if err != nil {
 		return
@@ -102,6 +199,51 @@ SELECT sites.id, '', '' FROM sites WHERE owner = $1 AND id = $2
 }
 
 func updateSource(pg *sqlx.DB, user string, source Source) (site Site, err error) {
+	if errs := validateSource(source); len(errs) > 0 {
+		err = errs
+		return
+	}
+
+	// a source saved without saying if it is enabled stays as it was, and
+	// a disabled one writes nothing that could conflict
+	if source.Enabled == nil {
+		var enabled bool
+		err = pg.Get(&enabled, `
+SELECT sources.enabled FROM sources
+INNER JOIN sites ON sources.site = sites.id
+WHERE sites.owner = $1 AND sources.id = $2
+        `, user, source.Id)
+		if err != nil {
+			return
+		}
+		source.Enabled = &enabled
+	}
+
+	// the other sources of the same site
+	var others []Source
+	err = pg.Select(&others, `
+SELECT others.id, others.provider, others.root, others.data, others.position,
+  others.enabled
+FROM sources
+INNER JOIN sites ON sources.site = sites.id
+INNER JOIN sources AS others ON others.site = sites.id
+WHERE sites.owner = $1 AND sources.id = $2 AND others.id != sources.id
+ORDER BY others.position, others.id
+    `, user, source.Id)
+	if err != nil {
+		return
+	}
+	var errs FieldErrors
+	for _, conflict := range pathConflicts(append(others, source)) {
+		if conflict.Source.Id == source.Id {
+			errs = append(errs, FieldError{"root", conflict.String()})
+		}
+	}
+	if len(errs) > 0 {
+		err = errs
+		return
+	}
+
 	var siteId int
 	err = pg.Get(&siteId, `
 WITH target AS (
@@ -109,10 +251,61 @@ WITH target AS (
   INNER JOIN sites ON sources.site = sites.id
   WHERE sites.owner = $1 AND sources.id = $2
 )
-UPDATE sources SET root=$3, provider=$4, data=$5
+UPDATE sources
+SET root=$3, provider=$4, data=$5, enabled=coalesce($6, enabled),
+  on_error=coalesce(nullif($7, ''), on_error)
 WHERE id = (SELECT source_id FROM target)
 RETURNING (SELECT site_id FROM target)
-    `, user, source.Id, source.Root, source.Provider, source.Data)
+    `, user, source.Id, source.Root, source.Provider, source.Data,
+		source.Enabled, source.OnError)
+	if err != nil {
+		return
+	}
+	return fetchSite(pg, user, siteId)
+}
+
+// ErrIncompleteOrder is returned when reordering with a list that isn't
+// made of exactly the sources of the site.
+var ErrIncompleteOrder = errors.New("the new order must have every source of the site once")
+
+// reorderSources sets the order of the sources of a site to the order of
+// sourceIds.
+func reorderSources(pg *sqlx.DB, user string, siteId int, sourceIds []int) (site Site, err error) {
+	var current []int
+	err = pg.Select(&current, `
+SELECT sources.id FROM sources
+INNER JOIN sites ON sources.site = sites.id
+WHERE sites.owner = $1 AND sites.id = $2
+    `, user, siteId)
+	if err != nil {
+		return
+	}
+
+	given := make(map[int]bool)
+	for _, id := range sourceIds {
+		given[id] = true
+	}
+	if len(given) != len(sourceIds) || len(given) != len(current) {
+		err = ErrIncompleteOrder
+		return
+	}
+	for _, id := range current {
+		if !given[id] {
+			err = ErrIncompleteOrder
+			return
+		}
+	}
+
+	ids := make([]int64, len(sourceIds))
+	for i, id := range sourceIds {
+		ids[i] = int64(id)
+	}
+	_, err = pg.Exec(`
+UPDATE sources SET position = neworder.position
+FROM unnest($3::int[]) WITH ORDINALITY AS neworder (id, position)
+WHERE sources.id = neworder.id
+  AND sources.site = (SELECT id FROM sites WHERE owner = $1 AND id = $2)
+    `, user, siteId, pq.Array(ids))
 	if err != nil {
 		return
 	}
@@ -126,6 +319,8 @@ WITH target AS (
   SELECT sources.id AS source_id, sites.id AS site_id FROM sources
   INNER JOIN sites ON sources.site = sites.id
   WHERE sites.owner = $1 AND sources.id = $2
+), udel AS (
+  DELETE FROM uploads WHERE source = (SELECT source_id FROM target)
 )
 DELETE FROM sources WHERE id = (SELECT source_id FROM target)
 RETURNING (SELECT site_id FROM target)
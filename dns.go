@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DNSProvider manages the records of the zone of mainHostname, where the
+// sites under it get their records. DNS_PROVIDER chooses which one we use,
+// "cloudflare" by default or "memory", which keeps them nowhere and is
+// useful for tests and local development. others, like Route53 or a
+// local PowerDNS or RFC 2136 server, only need to implement this and be
+// added to newDNSProvider.
+type DNSProvider interface {
+	// EnsureRecord creates the record, or updates the one with the same
+	// name and type so it has the same contents.
+	EnsureRecord(record DNSRecord) error
+
+	// RemoveRecord removes all records with this name.
+	RemoveRecord(name string) error
+
+	// ListRecords returns all the records in the zone.
+	ListRecords() ([]DNSRecord, error)
+}
+
+// DNSRecord has the full name of the record, like blog.sitios.xyz.
+type DNSRecord struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Proxied bool   `json:"proxied"`
+}
+
+var dns DNSProvider = newDNSProvider(os.Getenv("DNS_PROVIDER"))
+
+func newDNSProvider(kind string) DNSProvider {
+	switch kind {
+	case "memory":
+		return &memoryDNS{records: make(map[string]DNSRecord)}
+	default:
+		return newCloudflareDNS(
+			os.Getenv("CLOUDFLARE_KEY"),
+			os.Getenv("CLOUDFLARE_EMAIL"),
+			mainHostname,
+		)
+	}
+}
+
+// setupSubdomainDNS points a subdomain of mainHostname to the storage.
+func setupSubdomainDNS(subdomain string) error {
+	log.Debug().Str("CNAME", subdomain).Msg("setting dns record.")
+	return dns.EnsureRecord(DNSRecord{
+		Type:    "CNAME",
+		Name:    subdomain + "." + mainHostname,
+		Content: storage.CNAMETarget(),
+		Proxied: true,
+	})
+}
+
+func removeSubdomainDNS(domain string) error {
+	log.Debug().Str("domain", domain).Msg("removing dns record.")
+	return dns.RemoveRecord(domain)
+}
+
+// memoryDNS keeps records in memory only.
+type memoryDNS struct {
+	sync.Mutex
+	records map[string]DNSRecord // by type and name
+}
+
+func (m *memoryDNS) EnsureRecord(record DNSRecord) error {
+	if record.Name == "" || record.Type == "" {
+		return errors.New("record without name or type")
+	}
+
+	// names are case insensitive, as in any DNS server
+	record.Name = strings.ToLower(record.Name)
+
+	m.Lock()
+	defer m.Unlock()
+	m.records[record.Type+" "+record.Name] = record
+	return nil
+}
+
+func (m *memoryDNS) RemoveRecord(name string) error {
+	m.Lock()
+	defer m.Unlock()
+	for key, record := range m.records {
+		if strings.EqualFold(record.Name, name) {
+			delete(m.records, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryDNS) ListRecords() ([]DNSRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+	records := make([]DNSRecord, 0, len(m.records))
+	for _, record := range m.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
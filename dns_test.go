@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemoryDNS(t *testing.T) {
+	m := newDNSProvider("memory")
+
+	if err := m.EnsureRecord(DNSRecord{Type: "CNAME", Name: "b.sitios.xyz", Content: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.EnsureRecord(DNSRecord{Type: "CNAME", Name: "a.sitios.xyz", Content: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	// the same name and type is updated, not added
+	if err := m.EnsureRecord(DNSRecord{Type: "CNAME", Name: "B.sitios.xyz", Content: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.EnsureRecord(DNSRecord{Type: "TXT", Name: "b.sitios.xyz", Content: "text"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.EnsureRecord(DNSRecord{Type: "CNAME"}); err == nil {
+		t.Error("created a record without a name")
+	}
+
+	records, err := m.ListRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Name != "a.sitios.xyz" {
+		t.Fatalf("records are %v", records)
+	}
+	for _, record := range records[1:] {
+		if record.Type == "CNAME" && record.Content != "two" {
+			t.Errorf("record wasn't updated: %v", record)
+		}
+	}
+
+	// every record with the name goes
+	if err := m.RemoveRecord("b.sitios.xyz"); err != nil {
+		t.Fatal(err)
+	}
+	records, _ = m.ListRecords()
+	if len(records) != 1 || records[0].Name != "a.sitios.xyz" {
+		t.Errorf("records after removing are %v", records)
+	}
+	if err := m.RemoveRecord("nothing.sitios.xyz"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloudflareDNSWithoutClient(t *testing.T) {
+	c := &cloudflareDNS{apiErr: errors.New("invalid credentials"), zone: "sitios.xyz"}
+
+	if err := c.EnsureRecord(DNSRecord{Type: "CNAME", Name: "a.sitios.xyz"}); err == nil {
+		t.Error("created a record without a client")
+	}
+	if err := c.RemoveRecord("a.sitios.xyz"); err == nil {
+		t.Error("removed a record without a client")
+	}
+	if _, err := c.ListRecords(); err == nil {
+		t.Error("listed records without a client")
+	}
+}
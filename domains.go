@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sites under mainHostname get their DNS records from us, the others are
+// custom domains whose owners must point them to aliasHostname() with a
+// CNAME, or to prove they own them with a TXT record at
+// _sitios.{domain} when they can't have a CNAME, as in apex domains. we
+// don't publish sites with custom domains until one of those is seen.
+//
+// sites with custom domains are only created after the TXT record is
+// seen, until then there is just a pending claim for the domain. only the
+// TXT record proves who owns a domain, as a CNAME to us may have been
+// created by anyone else with a site there, so sites which never had it
+// seen (owner_proven) lose their domain to whoever shows it.
+
+// Resolver is what we use to look at DNS records. DNS_RESOLVER can be set
+// to the address of some other server, like a local stub, to be used
+// instead of the system one.
+type Resolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupTXT(ctx context.Context, host string) ([]string, error)
+}
+
+var resolver Resolver = newResolver(os.Getenv("DNS_RESOLVER"))
+
+func newResolver(address string) Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+const domainLookupTimeout = 10 * time.Second
+
+func isCustomDomain(domain string) bool {
+	return !strings.HasSuffix(domain, "."+mainHostname)
+}
+
+// aliasHostname is where custom domains must point to.
+func aliasHostname() string {
+	return "alias." + mainHostname
+}
+
+func verificationRecordName(domain string) string {
+	return "_sitios." + domain
+}
+
+func verificationRecordValue(token string) string {
+	return "sitios-verification=" + token
+}
+
+// DomainCheck tells what was found for a domain and what was expected.
+type DomainCheck struct {
+	Domain   string      `json:"domain"`
+	Verified bool        `json:"verified"`
+	CNAME    RecordCheck `json:"cname"`
+	TXT      RecordCheck `json:"txt"`
+}
+
+type RecordCheck struct {
+	Name     string   `json:"name"`
+	Expected string   `json:"expected"`
+	Found    []string `json:"found"`
+	Error    string   `json:"error,omitempty"`
+	OK       bool     `json:"ok"`
+}
+
+// verifyDomain looks at the DNS records of a site domain and saves whether
+// it is verified.
+func verifyDomain(pg *sqlx.DB, user string, siteId int) (check DomainCheck, err error) {
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+
+	var site struct {
+		Domain string `db:"domain"`
+		Token  string `db:"verify_token"`
+	}
+	err = pg.Get(&site, `
+UPDATE sites SET verify_token = coalesce(verify_token, $3)
+WHERE owner = $1 AND id = $2
+RETURNING domain, verify_token
+    `, user, siteId, hex.EncodeToString(b))
+	if err != nil {
+		return
+	}
+
+	check = checkDomain(site.Domain, site.Token)
+	_, err = pg.Exec(`
+UPDATE sites SET domain_verified = $2, owner_proven = owner_proven OR $3
+WHERE id = $1
+    `, siteId, check.Verified, check.TXT.OK)
+	return
+}
+
+func checkDomain(domain, token string) DomainCheck {
+	check := DomainCheck{
+		Domain: domain,
+		CNAME: RecordCheck{
+			Name:     domain,
+			Expected: aliasHostname(),
+			Found:    []string{},
+		},
+		TXT: RecordCheck{
+			Name:     verificationRecordName(domain),
+			Expected: verificationRecordValue(token),
+			Found:    []string{},
+		},
+	}
+	if !isCustomDomain(domain) {
+		check.Verified = true
+		return check
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), domainLookupTimeout)
+	defer cancel()
+
+	cname, err := resolver.LookupCNAME(ctx, domain)
+	if err != nil {
+		check.CNAME.Error = err.Error()
+	} else {
+		cname = strings.ToLower(strings.TrimSuffix(cname, "."))
+		check.CNAME.Found = append(check.CNAME.Found, cname)
+		check.CNAME.OK = cname == aliasHostname() || cname == storage.CNAMETarget()
+	}
+
+	txts, err := resolver.LookupTXT(ctx, check.TXT.Name)
+	if err != nil {
+		check.TXT.Error = err.Error()
+	} else {
+		check.TXT.Found = append(check.TXT.Found, txts...)
+		for _, txt := range txts {
+			if strings.TrimSpace(txt) == check.TXT.Expected {
+				check.TXT.OK = true
+			}
+		}
+	}
+
+	check.Verified = check.CNAME.OK || check.TXT.OK
+	return check
+}
+
+// DomainClaim is a pending request for a custom domain, waiting for the
+// TXT record to be created.
+type DomainClaim struct {
+	Domain  string      `json:"domain"`
+	Pending bool        `json:"pending"`
+	TXT     RecordCheck `json:"txt"`
+}
+
+// ErrDomainReserved is returned when creating a site with a subdomain of
+// mainHostname that we use for something else.
+var ErrDomainReserved = errors.New("this domain is reserved")
+
+var reservedSubdomain = regexp.MustCompile(`^(alias|preview-.*|site-\d+)$`)
+
+// isReservedDomain tells if domain is aliasHostname(), the service itself
+// or one of the names we give to previews and to the sites moved out of a
+// domain.
+func isReservedDomain(domain string) bool {
+	if domain == serviceHostname() {
+		return true
+	}
+	if isCustomDomain(domain) {
+		return false
+	}
+	return reservedSubdomain.MatchString(strings.TrimSuffix(domain, "."+mainHostname))
+}
+
+// cleanDomain lowercases a domain given by a user and checks it is valid
+// and not reserved.
+func cleanDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if err := validDomain(domain); err != nil {
+		return domain, err
+	}
+	if isReservedDomain(domain) {
+		return domain, ErrDomainReserved
+	}
+	return domain, nil
+}
+
+// claimDomain creates a site for domain. for custom domains that only
+// happens once the user has proven to own it, before that the pending
+// claim is returned. a site of someone else that has the domain without
+// having verified it gets moved to a subdomain of mainHostname.
+func claimDomain(pg *sqlx.DB, user, domain string) (id int, claim *DomainClaim, err error) {
+	domain, err = cleanDomain(domain)
+	if err != nil {
+		return
+	}
+	if !isCustomDomain(domain) {
+		id, err = createSite(pg, user, domain)
+		return
+	}
+
+	token, claim, err := proveDomain(pg, user, domain)
+	if err != nil || claim != nil {
+		return
+	}
+
+	// a publish of a site being moved away must not touch the target
+	// while we empty it
+	unlock := lockSiteActivation(domain)
+	defer unlock()
+
+	id, reclaimed, err := takeDomain(pg, user, domain, token)
+	if err != nil {
+		return
+	}
+	if reclaimed {
+		// the files there are of the sites moved away
+		err = storage.RemoveTarget(domain)
+		if err != nil {
+			return
+		}
+	}
+	err = forgetClaim(pg, user, domain)
+	return
+}
+
+// proveDomain checks if the user has the TXT record for a custom domain
+// and returns the token in it if so, otherwise the pending claim.
+func proveDomain(pg *sqlx.DB, user, domain string) (token string, claim *DomainClaim, err error) {
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	err = pg.Get(&token, `
+INSERT INTO domain_claims (domain, owner, token) VALUES ($1, $2, $3)
+ON CONFLICT (domain, owner) DO UPDATE SET domain = excluded.domain
+RETURNING token
+    `, domain, user, hex.EncodeToString(b))
+	if err != nil {
+		return
+	}
+
+	check := checkDomain(domain, token)
+	if !check.TXT.OK {
+		return "", &DomainClaim{Domain: domain, Pending: true, TXT: check.TXT}, nil
+	}
+	return token, nil, nil
+}
+
+func forgetClaim(pg *sqlx.DB, user, domain string) error {
+	_, err := pg.Exec(`
+DELETE FROM domain_claims WHERE domain = $1 AND owner = $2
+    `, domain, user)
+	return err
+}
+
+// takeDomain creates a verified site for a domain the user has proven to
+// own, moving away any unverified site of someone else that had it, in
+// which case reclaimed is true.
+func takeDomain(pg *sqlx.DB, user, domain, token string) (id int, reclaimed bool, err error) {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	// the user may already have a site with it, made before we asked for
+	// proofs
+	err = tx.Get(&id, `
+UPDATE sites SET domain_verified = true, owner_proven = true, verify_token = $3
+WHERE domain = $1 AND owner = $2
+RETURNING id
+    `, domain, user, token)
+	if err == nil {
+		err = tx.Commit()
+		return
+	}
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	used, err := domainInUse(tx, domain, 0)
+	if err != nil {
+		return
+	}
+	if used {
+		err = ErrDomainTaken
+		return
+	}
+
+	moved, err := moveSquatters(tx, user, domain)
+	if err != nil {
+		return
+	}
+	reclaimed = moved > 0
+
+	err = tx.Get(&id, `
+INSERT INTO sites (owner, domain, domain_verified, owner_proven, verify_token)
+VALUES ($1, $2, true, true, $3)
+ON CONFLICT (domain) DO NOTHING
+RETURNING id
+    `, user, domain, token)
+	if err == sql.ErrNoRows {
+		err = ErrDomainTaken
+	}
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// moveSquatters moves to subdomains of mainHostname the sites of other
+// users with a domain they never proved to own, which the user has, and
+// says how many there were.
+func moveSquatters(tx *sqlx.Tx, user, domain string) (int, error) {
+	var squatters []int
+	err := tx.Select(&squatters, `
+SELECT id FROM sites
+WHERE domain = $1 AND owner != $2 AND NOT owner_proven
+FOR UPDATE
+    `, domain, user)
+	if err != nil {
+		return 0, err
+	}
+	for _, squatter := range squatters {
+		moved := "site-" + strconv.Itoa(squatter) + "." + mainHostname
+		_, err = tx.Exec(`
+UPDATE sites SET domain = $2, domain_verified = true, live_build = NULL
+WHERE id = $1
+    `, squatter, moved)
+		if err != nil {
+			return 0, err
+		}
+		log.Info().
+			Int("site", squatter).
+			Str("domain", domain).
+			Str("moved", moved).
+			Str("user", user).
+			Msg("domain reclaimed by its owner")
+	}
+	return len(squatters), nil
+}
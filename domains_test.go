@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeResolver answers from maps, names missing from them fail like a
+// lookup of a name that doesn't exist.
+type fakeResolver struct {
+	cnames map[string]string
+	txts   map[string][]string
+}
+
+func (f fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	if cname, ok := f.cnames[host]; ok {
+		return cname, nil
+	}
+	return "", errors.New("no such host")
+}
+
+func (f fakeResolver) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	if txts, ok := f.txts[host]; ok {
+		return txts, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestCheckDomain(t *testing.T) {
+	defer func(m, s string, st StorageBackend, r Resolver) {
+		mainHostname, serviceURL, storage, resolver = m, s, st, r
+	}(mainHostname, serviceURL, storage, resolver)
+
+	mainHostname = "sitios.xyz"
+	serviceURL = "https://app.sitios.xyz"
+	storage = s3Storage{}
+
+	for _, test := range []struct {
+		name     string
+		cnames   map[string]string
+		txts     map[string][]string
+		cname    bool
+		txt      bool
+		errors   bool
+		verified bool
+	}{
+		{"alias",
+			map[string]string{"blog.com": "Alias.sitios.xyz."}, nil,
+			true, false, false, true},
+		{"storage",
+			map[string]string{"blog.com": "s3-website-us-east-1.amazonaws.com."}, nil,
+			true, false, false, true},
+		{"elsewhere",
+			map[string]string{"blog.com": "blog.herokuapp.com."}, nil,
+			false, false, false, false},
+		{"txt",
+			nil, map[string][]string{"_sitios.blog.com": {"other", "  sitios-verification=tok \n"}},
+			false, true, false, true},
+		{"wrong token",
+			nil, map[string][]string{"_sitios.blog.com": {"sitios-verification=other"}},
+			false, false, false, false},
+		{"lookup errors",
+			nil, nil,
+			false, false, true, false},
+	} {
+		resolver = fakeResolver{test.cnames, test.txts}
+		check := checkDomain("blog.com", "tok")
+
+		if check.CNAME.OK != test.cname || check.TXT.OK != test.txt {
+			t.Errorf("%s: cname ok is %v and txt ok is %v", test.name, check.CNAME.OK, check.TXT.OK)
+		}
+		if check.Verified != test.verified {
+			t.Errorf("%s: verified is %v", test.name, check.Verified)
+		}
+		failed := check.CNAME.Error != "" && check.TXT.Error != ""
+		if failed != test.errors {
+			t.Errorf("%s: errors are %q and %q", test.name, check.CNAME.Error, check.TXT.Error)
+		}
+	}
+
+	// ours are verified without looking
+	resolver = fakeResolver{}
+	if check := checkDomain("blog.sitios.xyz", "tok"); !check.Verified {
+		t.Errorf("subdomain wasn't verified: %+v", check)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// list providers, like feed:rss, render an index of their entries at root,
+// continued on root/p/2/ and so on, and a page for each entry at
+// root/{slug}/, the same way the sitio list plugins do.
+
+var entriesTemplate = template.Must(template.ParseFiles("templates/entries.html"))
+var entryTemplate = template.Must(template.ParseFiles("templates/entry.html"))
+
+const defaultPostsPerPage = 7
+
+// Entry is a post of a list provider.
+type Entry struct {
+	Title   string
+	Slug    string // name of its page, made from the title if empty
+	Link    string // where it was originally published, if anywhere
+	Date    time.Time
+	Summary template.HTML // shown in the index instead of Content with excerpts
+	Content template.HTML
+
+	Path string
+}
+
+type listData struct {
+	PostsPerPage int  `json:"postsPerPage"`
+	Excerpts     bool `json:"excerpts"`
+}
+
+// renderEntries returns the pages for entries under root.
+func renderEntries(root string, entries []Entry, list listData) ([]Page, error) {
+	root = normalizeRoot(root)
+	perPage := list.PostsPerPage
+	if perPage < 1 {
+		perPage = defaultPostsPerPage
+	}
+
+	// "p" is where the index continues, and at the root "error" is where
+	// the error page is
+	used := map[string]bool{"p": true}
+	if root == "/" {
+		used[strings.Trim(errorPagePath, "/")] = true
+	}
+	var pages []Page
+	for i := range entries {
+		entry := &entries[i]
+		entry.Path = root + uniqueSlug(used, entry.Slug, entry.Title) + "/"
+		if entry.Summary == "" {
+			entry.Summary = template.HTML(excerpt(string(entry.Content)))
+		}
+
+		var content bytes.Buffer
+		err := entryTemplate.Execute(&content, entry)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, Page{
+			Path:    entry.Path,
+			Title:   entry.Title,
+			Content: template.HTML(content.String()),
+		})
+	}
+
+	indexPath := func(n int) string {
+		if n == 1 {
+			return root
+		}
+		return root + "p/" + strconv.Itoa(n) + "/"
+	}
+	for n := 1; n == 1 || (n-1)*perPage < len(entries); n++ {
+		start := (n - 1) * perPage
+		end := start + perPage
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		index := struct {
+			Entries    []Entry
+			Excerpts   bool
+			Prev, Next string
+		}{Entries: entries[start:end], Excerpts: list.Excerpts}
+		if n > 1 {
+			index.Prev = indexPath(n - 1)
+		}
+		if end < len(entries) {
+			index.Next = indexPath(n + 1)
+		}
+
+		var content bytes.Buffer
+		err := entriesTemplate.Execute(&content, index)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, Page{
+			Path:    indexPath(n),
+			Content: template.HTML(content.String()),
+		})
+	}
+	return pages, nil
+}
+
+var notSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+func uniqueSlug(used map[string]bool, slug, title string) string {
+	if slug == "" {
+		slug = strings.Trim(notSlug.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	}
+	if slug == "" {
+		slug = "entry"
+	}
+
+	unique := slug
+	for n := 2; used[unique]; n++ {
+		unique = slug + "-" + strconv.Itoa(n)
+	}
+	used[unique] = true
+	return unique
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// excerpt is the start of the text of some HTML, escaped.
+func excerpt(content string) string {
+	text := html.UnescapeString(htmlTag.ReplaceAllString(content, " "))
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > 280 {
+		text = string(runes[:280]) + "…"
+	}
+	return template.HTMLEscapeString(text)
+}
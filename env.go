@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt is the positive integer in the environment variable name, or def
+// when it is missing or isn't one.
+func envInt(name string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n < 1 {
+		return def
+	}
+	return n
+}
+
+// envDuration is like envInt, for durations like "90s" or "6h".
+func envDuration(name string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEnvNumbers(t *testing.T) {
+	defer os.Unsetenv("SITIOS_TEST_ENV")
+
+	for _, test := range []struct {
+		value    string
+		n        int
+		duration time.Duration
+	}{
+		{"", 3, time.Hour},
+		{"12", 12, time.Hour},
+		{"0", 3, time.Hour},
+		{"-4", 3, time.Hour},
+		{"many", 3, time.Hour},
+		{"90s", 3, 90 * time.Second},
+		{"-1m", 3, time.Hour},
+	} {
+		os.Setenv("SITIOS_TEST_ENV", test.value)
+		if n := envInt("SITIOS_TEST_ENV", 3); n != test.n {
+			t.Errorf("%q is %d as an int", test.value, n)
+		}
+		if d := envDuration("SITIOS_TEST_ENV", time.Hour); d != test.duration {
+			t.Errorf("%q is %s as a duration", test.value, d)
+		}
+	}
+}
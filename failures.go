@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// a source that fails while generating is handled according to its
+// on_error policy: the default is to fail the whole build, but it can
+// also be skipped, keeping what it produced in the live version, or be
+// replaced by a page saying it is unavailable.
+
+const (
+	onErrorFail        = "fail"
+	onErrorSkip        = "skip"
+	onErrorPlaceholder = "placeholder"
+)
+
+// SourceStatus is how a source fared in a build. it is saved with the
+// build, so the files are also what a later build will keep if the source
+// is skipped.
+type SourceStatus struct {
+	Id       int      `json:"id"`
+	Provider string   `json:"provider"`
+	Root     string   `json:"root"`
+	Status   string   `json:"status"` // ok, failed, skipped or placeholder
+	Error    string   `json:"error,omitempty"`
+	Files    []string `json:"files"` // keys under _site written by the source
+}
+
+func newSourceStatus(source Source) SourceStatus {
+	return SourceStatus{
+		Id:       source.Id,
+		Provider: source.Provider,
+		Root:     source.Root,
+		Status:   "ok",
+		Files:    []string{},
+	}
+}
+
+func (status *SourceStatus) fail(err error) {
+	status.Status = "failed"
+	status.Error = err.Error()
+}
+
+// applyFailurePolicies handles every failed source in statuses, which is
+// updated to tell what was done, skipped ones get their files from live.
+// it fails if any of them can't be handled or must fail the build.
+func applyFailurePolicies(live liveOutput, globals map[string]interface{}, sources []Source, statuses []SourceStatus, target string, out *logproxy) error {
+	byId := make(map[int]Source)
+	for _, source := range sources {
+		byId[source.Id] = source
+	}
+
+	for i := range statuses {
+		status := &statuses[i]
+		if status.Status != "failed" {
+			continue
+		}
+		source := byId[status.Id]
+		out.Print("Source " + describeSource(source) + " failed: " + status.Error)
+
+		// whatever it managed to write is incomplete
+		for _, key := range status.Files {
+			if filename, err := sitePath(target, key); err == nil {
+				os.Remove(filename)
+			}
+		}
+		status.Files = []string{}
+
+		switch source.OnError {
+		case onErrorSkip:
+			files, err := restoreLastGoodOutput(live, source.Id, target)
+			if err != nil {
+				return errors.New("restoring previous output of " +
+					describeSource(source) + ": " + err.Error())
+			}
+			status.Status = "skipped"
+			status.Files = files
+			out.Print("Keeping its " + strconv.Itoa(len(files)) + " files from the live version.")
+		case onErrorPlaceholder:
+			page := Page{
+				Path:    normalizeRoot(source.Root),
+				Title:   "Unavailable",
+				Content: "<p>This content is temporarily unavailable.</p>",
+			}
+			err := renderPage(target, newLayoutGlobals(globals), page)
+			if err != nil {
+				return err
+			}
+			status.Status = "placeholder"
+			status.Files = []string{page.Path[1:] + "index.html"}
+			out.Print("Replaced by a placeholder page.")
+		default:
+			return errors.New("source " + describeSource(source) + " failed: " + status.Error)
+		}
+	}
+	return nil
+}
+
+// liveOutput is what each source wrote in the live version of a site.
+type liveOutput struct {
+	Domain   string
+	Statuses []SourceStatus
+}
+
+// fetchLiveOutput is empty for a site that was never published.
+func fetchLiveOutput(siteId int) (live liveOutput, err error) {
+	var row struct {
+		Domain  string         `db:"domain"`
+		Sources types.JSONText `db:"sources"`
+	}
+	err = pg.Get(&row, `
+SELECT sites.domain, site_builds.sources
+FROM sites
+INNER JOIN site_builds ON site_builds.id = sites.live_build
+WHERE sites.id = $1
+    `, siteId)
+	if err == sql.ErrNoRows {
+		return live, nil
+	}
+	if err != nil {
+		return
+	}
+
+	live.Domain = row.Domain
+	err = row.Sources.Unmarshal(&live.Statuses)
+	return
+}
+
+// restoreLastGoodOutput copies to target the files a source had in the
+// live version of its site and returns their keys.
+func restoreLastGoodOutput(live liveOutput, sourceId int, target string) (files []string, err error) {
+	files = []string{}
+	for _, status := range live.Statuses {
+		if status.Id == sourceId {
+			files = status.Files
+		}
+	}
+
+	for _, key := range files {
+		err = restoreLiveFile(live.Domain, key, target)
+		if err != nil {
+			return nil, errors.New(key + ": " + err.Error())
+		}
+	}
+	return files, nil
+}
+
+func restoreLiveFile(domain, key, target string) error {
+	filename, err := sitePath(target, key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	r, err := storage.ReadLive(domain, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
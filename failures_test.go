@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyFailurePolicies(t *testing.T) {
+	defer func(st StorageBackend) { storage = st }(storage)
+
+	dir, err := ioutil.TempDir("", "sitios-sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage = localStorage{dir: dir}
+
+	// what the source wrote when the site was last published
+	tree := writeTree(t, map[string]string{
+		"index.html":         "home",
+		"cards/index.html":   "old cards",
+		"cards/a/index.html": "old card",
+	})
+	defer os.RemoveAll(tree)
+	if err := storage.EnsureTarget("blog.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.UploadTree("blog.com", "1", tree); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Activate("blog.com", "1"); err != nil {
+		t.Fatal(err)
+	}
+	live := liveOutput{"blog.com", []SourceStatus{
+		{Id: 1, Status: "ok", Files: []string{"index.html"}},
+		{Id: 2, Status: "ok", Files: []string{"cards/index.html", "cards/a/index.html"}},
+	}}
+
+	for _, test := range []struct {
+		name   string
+		policy string
+		live   liveOutput
+		fails  bool
+		status string
+		files  map[string]string
+	}{
+		{"skip", onErrorSkip, live, false, "skipped",
+			map[string]string{"cards/index.html": "old cards", "cards/a/index.html": "old card"}},
+		{"skip unpublished", onErrorSkip, liveOutput{}, false, "skipped",
+			map[string]string{}},
+		{"placeholder", onErrorPlaceholder, live, false, "placeholder",
+			map[string]string{"cards/index.html": "temporarily unavailable"}},
+		{"fail", onErrorFail, live, true, "failed", map[string]string{}},
+		{"default", "", live, true, "failed", map[string]string{}},
+	} {
+		target, err := ioutil.TempDir("", "sitios-site")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(target)
+
+		// it failed halfway
+		partial := filepath.Join(target, "cards", "b", "index.html")
+		os.MkdirAll(filepath.Dir(partial), 0755)
+		ioutil.WriteFile(partial, []byte("half a card"), 0644)
+
+		sources := []Source{
+			{Id: 1, Provider: "url:html", Root: "/"},
+			{Id: 2, Provider: "trello:list", Root: "/cards", OnError: test.policy},
+		}
+		statuses := []SourceStatus{
+			{Id: 1, Status: "ok", Files: []string{}},
+			{Id: 2, Status: "failed", Error: "trello is down", Files: []string{"cards/b/index.html"}},
+		}
+		err = applyFailurePolicies(test.live, map[string]interface{}{}, sources, statuses, target, &logproxy{})
+
+		if test.fails && (err == nil || !strings.Contains(err.Error(), "trello is down")) {
+			t.Errorf("%s: didn't fail the build: %v", test.name, err)
+		}
+		if !test.fails && err != nil {
+			t.Errorf("%s: failed the build: %s", test.name, err)
+		}
+		if statuses[1].Status != test.status || statuses[0].Status != "ok" {
+			t.Errorf("%s: statuses are %+v", test.name, statuses)
+		}
+		if len(statuses[1].Files) != len(test.files) {
+			t.Errorf("%s: files are %v", test.name, statuses[1].Files)
+		}
+
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Errorf("%s: partial output was kept", test.name)
+		}
+		for key, contents := range test.files {
+			b, err := ioutil.ReadFile(filepath.Join(target, key))
+			if err != nil || !strings.Contains(string(b), contents) {
+				t.Errorf("%s: %s is %q (%v)", test.name, key, b, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// feedProvider renders the entries of an RSS or Atom feed.
+type feedProvider struct{}
+
+type feedData struct {
+	URL string `json:"url"`
+	listData
+}
+
+var feedFields = []field{
+	{"url", "url", true},
+	{"postsPerPage", "int", false},
+	{"excerpts", "bool", false},
+}
+
+func (p feedProvider) Validate(data types.JSONText) FieldErrors {
+	return validateFields(feedFields, data)
+}
+
+func (p feedProvider) Paths(root string, data types.JSONText) []string {
+	return []string{root, root + "p/*"}
+}
+
+func (p feedProvider) Render(source Source) ([]Page, []File, error) {
+	var d feedData
+	err := source.Data.Unmarshal(&d)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := fetchText(d.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := parseFeed(body)
+	if err != nil {
+		return nil, nil, errors.New("reading feed: " + err.Error())
+	}
+
+	pages, err := renderEntries(source.Root, entries, d.listData)
+	return pages, nil, err
+}
+
+// RSS 2.0, and RSS 1.0 whose items are outside the channel.
+type rssFeed struct {
+	Items        []rssItem `xml:"item"`
+	ChannelItems []rssItem `xml:"channel>item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PubDate     string `xml:"pubDate"`
+	Date        string `xml:"http://purl.org/dc/elements/1.1/ date"`
+}
+
+type atomFeed struct {
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title atomText `xml:"title"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Summary   atomText `xml:"summary"`
+	Content   atomText `xml:"content"`
+	Published string   `xml:"published"`
+	Updated   string   `xml:"updated"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+// HTML returns the text as HTML whatever its type.
+func (t atomText) HTML() template.HTML {
+	switch t.Type {
+	case "html":
+		return template.HTML(t.Text)
+	case "xhtml":
+		return template.HTML(t.Inner)
+	default:
+		return template.HTML(template.HTMLEscapeString(t.Text))
+	}
+}
+
+func parseFeed(body string) (entries []Entry, err error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	err = decodeXML(body, &root)
+	if err != nil {
+		return
+	}
+
+	switch root.XMLName.Local {
+	case "feed":
+		var feed atomFeed
+		err = decodeXML(body, &feed)
+		if err != nil {
+			return
+		}
+		for _, e := range feed.Entries {
+			entry := Entry{
+				Title:   strings.TrimSpace(e.Title.Text),
+				Date:    parseFeedDate(e.Published, e.Updated),
+				Summary: e.Summary.HTML(),
+				Content: e.Content.HTML(),
+			}
+			if entry.Content == "" {
+				entry.Content = entry.Summary
+			}
+			for _, link := range e.Links {
+				if link.Rel == "" || link.Rel == "alternate" {
+					entry.Link = link.Href
+					break
+				}
+			}
+			entries = append(entries, entry)
+		}
+	case "rss", "RDF":
+		var feed rssFeed
+		err = decodeXML(body, &feed)
+		if err != nil {
+			return
+		}
+		for _, item := range append(feed.ChannelItems, feed.Items...) {
+			entry := Entry{
+				Title:   strings.TrimSpace(item.Title),
+				Link:    strings.TrimSpace(item.Link),
+				Date:    parseFeedDate(item.PubDate, item.Date),
+				Content: template.HTML(item.Content),
+			}
+			if item.Content == "" {
+				entry.Content = template.HTML(item.Description)
+			} else {
+				entry.Summary = template.HTML(item.Description)
+			}
+			entries = append(entries, entry)
+		}
+	default:
+		err = errors.New("not an RSS or Atom feed")
+	}
+	return
+}
+
+func decodeXML(body string, v interface{}) error {
+	decoder := xml.NewDecoder(strings.NewReader(body))
+	decoder.Strict = false
+	// fetchText already gave us text, whatever the feed says its
+	// encoding is
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	return decoder.Decode(v)
+}
+
+var feedDateFormats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2006-01-02",
+}
+
+// parseFeedDate returns the first of the dates that can be parsed.
+func parseFeedDate(dates ...string) time.Time {
+	for _, date := range dates {
+		date = strings.TrimSpace(date)
+		for _, format := range feedDateFormats {
+			if t, err := time.Parse(format, date); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+const rssFixture = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/">
+  <channel>
+    <title>A blog</title>
+    <item>
+      <title>First post</title>
+      <link>https://example.com/first</link>
+      <pubDate>Mon, 02 Jan 2017 15:04:05 +0000</pubDate>
+      <description>&lt;p&gt;the summary&lt;/p&gt;</description>
+      <content:encoded><![CDATA[<p>the whole post</p>]]></content:encoded>
+    </item>
+    <item>
+      <title>Second post</title>
+      <link>https://example.com/second</link>
+      <description>&lt;p&gt;only a description&lt;/p&gt;</description>
+    </item>
+  </channel>
+</rss>`
+
+const atomFixture = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Another blog</title>
+  <entry>
+    <title>An entry</title>
+    <link rel="self" href="https://example.com/feed/1"/>
+    <link rel="alternate" href="https://example.com/1"/>
+    <updated>2017-01-02T15:04:05Z</updated>
+    <content type="html">&lt;p&gt;hello&lt;/p&gt;</content>
+  </entry>
+  <entry>
+    <title>Plain</title>
+    <published>2017-01-03T00:00:00Z</published>
+    <summary type="text">a &lt; b</summary>
+  </entry>
+</feed>`
+
+func TestParseFeed(t *testing.T) {
+	server := fixtureServer(map[string]string{
+		"/rss.xml":  rssFixture,
+		"/atom.xml": atomFixture,
+		"/page":     "<html><body>not a feed</body></html>",
+	})
+	defer server.Close()
+
+	body, err := fetchText(server.URL + "/rss.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseFeed(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d rss entries, not 2", len(entries))
+	}
+	first := entries[0]
+	if first.Title != "First post" || first.Link != "https://example.com/first" ||
+		!first.Date.Equal(time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)) ||
+		first.Content != "<p>the whole post</p>" || first.Summary != "<p>the summary</p>" {
+		t.Errorf("first rss entry is %+v", first)
+	}
+	if second := entries[1]; second.Content != "<p>only a description</p>" ||
+		second.Summary != "" || !second.Date.IsZero() {
+		t.Errorf("second rss entry is %+v", second)
+	}
+
+	body, err = fetchText(server.URL + "/atom.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = parseFeed(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d atom entries, not 2", len(entries))
+	}
+	first = entries[0]
+	if first.Title != "An entry" || first.Link != "https://example.com/1" ||
+		first.Content != "<p>hello</p>" || first.Date.Year() != 2017 {
+		t.Errorf("first atom entry is %+v", first)
+	}
+	if second := entries[1]; second.Summary != "a &lt; b" || second.Content != second.Summary ||
+		second.Date.Day() != 3 {
+		t.Errorf("second atom entry is %+v", second)
+	}
+
+	body, err = fetchText(server.URL + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseFeed(body); err == nil {
+		t.Error("parsed an html page as a feed")
+	}
+}
+
+func TestFeedProviderRender(t *testing.T) {
+	server := fixtureServer(map[string]string{"/rss.xml": rssFixture})
+	defer server.Close()
+
+	pages, _, err := feedProvider{}.Render(Source{
+		Root:     "/blog",
+		Provider: "feed:rss",
+		Data:     types.JSONText(`{"url": "` + server.URL + `/rss.xml", "postsPerPage": 1}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make([]string, len(pages))
+	for i, page := range pages {
+		paths[i] = page.Path
+	}
+	expected := []string{"/blog/first-post/", "/blog/second-post/", "/blog/", "/blog/p/2/"}
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Errorf("pages are %v, not %v", paths, expected)
+	}
+	if !strings.Contains(string(pages[2].Content), "/blog/p/2/") {
+		t.Error("the first index page doesn't link to the second")
+	}
+}
+
+func TestEntrySlugs(t *testing.T) {
+	entries := []Entry{{Title: "Error"}, {Title: "P"}, {Title: "Hello"}, {Title: "Hello"}}
+	pages, err := renderEntries("/", entries, listData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, len(pages))
+	for i, page := range pages {
+		paths[i] = page.Path
+	}
+	expected := []string{"/error-2/", "/p-2/", "/hello/", "/hello-2/", "/"}
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Errorf("pages are %v, not %v", paths, expected)
+	}
+
+	// only the root has the error page
+	pages, _ = renderEntries("/blog", entries[:1], listData{})
+	if pages[0].Path != "/blog/error/" {
+		t.Errorf("entry is at %s", pages[0].Path)
+	}
+}
+
+func TestFeedEntriesOverOtherSources(t *testing.T) {
+	server := fixtureServer(map[string]string{"/rss.xml": rssFixture})
+	defer server.Close()
+
+	feed := Source{Id: 1, Root: "/", Provider: "feed:rss",
+		Data: types.JSONText(`{"url": "` + server.URL + `/rss.xml"}`)}
+	// rendered by sitio, so not by renderSources
+	list := Source{Id: 2, Root: "/second-post", Provider: "trello:list",
+		Data: types.JSONText(`{"apiKey": "k", "apiToken": "t", "id": "l"}`)}
+
+	for _, test := range []struct {
+		all      []Source
+		conflict bool
+	}{
+		{[]Source{feed}, false},
+		{[]Source{feed, list}, true},
+	} {
+		target, err := ioutil.TempDir("", "sitios-site")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(target)
+
+		_, err = renderSources(layoutGlobals{}, []Source{feed}, test.all, target, &logproxy{})
+		if test.conflict && (err == nil || !strings.Contains(err.Error(), "trello:list")) {
+			t.Errorf("feed entries overwrote the pages of a sitio source: %v", err)
+		}
+		if !test.conflict && err != nil {
+			t.Errorf("rendering alone failed: %s", err)
+		}
+	}
+}
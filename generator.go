@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the native generator renders sites without node, using the same layout
+// as skeleton/body.js. sites choose it by setting their generator to
+// "native", all others keep being generated by sitio.
+
+var layout = template.Must(template.ParseFiles("templates/layout.html"))
+
+// Page is a page rendered inside the layout, at path/index.html.
+type Page struct {
+	Path    string
+	Title   string
+	Content template.HTML
+}
+
+// File is written as it is.
+type File struct {
+	Path string
+	Data []byte
+}
+
+type layoutGlobals struct {
+	Name        string
+	Favicon     string
+	Header      string
+	Description template.HTML
+	Aside       template.HTML
+	Footer      template.HTML
+	CSS         []string
+	JS          []string
+	Nav         []navItem
+}
+
+type navItem struct {
+	URL  string
+	Text string
+}
+
+// newLayoutGlobals takes the same globals given to generate.js, with
+// description, aside and footer already rendered from markdown.
+func newLayoutGlobals(globals map[string]interface{}) layoutGlobals {
+	g := layoutGlobals{
+		Name:        str(globals["name"]),
+		Favicon:     str(globals["favicon"]),
+		Header:      str(globals["header"]),
+		Description: template.HTML(str(globals["description"])),
+		Aside:       template.HTML(str(globals["aside"])),
+		Footer:      template.HTML(str(globals["footer"])),
+	}
+	if includes, ok := globals["includes"].([]interface{}); ok {
+		for _, iinclude := range includes {
+			include := str(iinclude)
+			switch {
+			case isCSS(include):
+				g.CSS = append(g.CSS, include)
+			case isJS(include):
+				g.JS = append(g.JS, include)
+			}
+		}
+	}
+	if nav, ok := globals["nav"].([]interface{}); ok {
+		for _, ini := range nav {
+			if ni, ok := ini.(map[string]interface{}); ok {
+				g.Nav = append(g.Nav, navItem{URL: str(ni["url"]), Text: str(ni["txt"])})
+			}
+		}
+	}
+	return g
+}
+
+// generateNative renders the sources into target. a source that fails
+// doesn't stop the others, its failure is in the returned statuses.
+func generateNative(globals map[string]interface{}, sources []Source, target string, out *logproxy) ([]SourceStatus, error) {
+	g := newLayoutGlobals(globals)
+
+	statuses, err := renderSources(g, sources, sources, target, out)
+	if err != nil {
+		return statuses, err
+	}
+
+	// the page S3 and siteServer show when something is not found
+	return statuses, renderPage(target, g, Page{
+		Path:    errorPagePath,
+		Title:   "Not found",
+		Content: "<h1>Page not found</h1>",
+	})
+}
+
+// renderSources renders each source with its Go provider inside the
+// layout. sitio sites use it too, for the providers sitio doesn't have, in
+// which case all has every source of the site and target already has what
+// the sitio plugins wrote.
+func renderSources(g layoutGlobals, sources []Source, all []Source, target string, out *logproxy) ([]SourceStatus, error) {
+	// pages of entries can still collide, which pathConflicts can't see
+	written := make(map[string]Source)
+	claim := func(source Source, name string) error {
+		if other, ok := written[name]; ok {
+			if other.Id != source.Id {
+				return errors.New(describeSource(source) + " would overwrite " +
+					name + " of " + describeSource(other))
+			}
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(target, name)); err == nil {
+			return errors.New(describeSource(source) + " would overwrite " +
+				name + ", written by a sitio plugin")
+		}
+		written[name] = source
+		return nil
+	}
+	// and with the paths other sources say they write to
+	claimPage := func(source Source, page Page) error {
+		dir := normalizeRoot(page.Path)
+		if pathsOverlap(dir, errorPagePath) {
+			return errors.New(describeSource(source) + " would overwrite the error page")
+		}
+		for _, other := range all {
+			if other.Id == source.Id {
+				continue
+			}
+			for _, p := range sourcePaths(other) {
+				if pathsOverlap(dir, p) {
+					return errors.New(describeSource(source) + " would overwrite " +
+						p + " of " + describeSource(other))
+				}
+			}
+		}
+		return nil
+	}
+
+	statuses := make([]SourceStatus, len(sources))
+	for i, source := range sources {
+		out.Print("Rendering " + source.Provider + " on " + source.Root + ".")
+		status := &statuses[i]
+		*status = newSourceStatus(source)
+
+		provider, ok := providers[source.Provider]
+		if !ok {
+			status.fail(errors.New("unknown provider " + source.Provider))
+			continue
+		}
+		pages, files, err := provider.Render(source)
+		if err != nil {
+			status.fail(err)
+			continue
+		}
+
+		for _, page := range pages {
+			name := path.Join("/", page.Path, "index.html")
+			err = claimPage(source, page)
+			if err != nil {
+				return statuses, err
+			}
+			err = claim(source, name)
+			if err != nil {
+				return statuses, err
+			}
+			err = renderPage(target, g, page)
+			if err != nil {
+				return statuses, err
+			}
+			status.Files = append(status.Files, name[1:])
+		}
+		for _, file := range files {
+			name := path.Join("/", file.Path)
+			err = claim(source, name)
+			if err != nil {
+				return statuses, err
+			}
+			err = writeSiteFile(target, file.Path, file.Data)
+			if err != nil {
+				return statuses, err
+			}
+			status.Files = append(status.Files, name[1:])
+		}
+	}
+	return statuses, nil
+}
+
+func renderPage(target string, g layoutGlobals, page Page) error {
+	filename, err := sitePath(target, path.Join(page.Path, "index.html"))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return layout.Execute(f, struct {
+		Global  layoutGlobals
+		Title   string
+		Content template.HTML
+	}{g, page.Title, page.Content})
+}
+
+func writeSiteFile(target, name string, data []byte) error {
+	filename, err := sitePath(target, name)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// sitePath turns a site path into a file path inside target, never
+// outside it.
+func sitePath(target, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "", errors.New("invalid path: " + name)
+	}
+	return filepath.Join(target, filepath.FromSlash(clean)), nil
+}
+
+func str(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func isJS(url string) bool {
+	return strings.HasSuffix(strings.Split(url, "?")[0], ".js")
+}
+
+func isCSS(url string) bool {
+	return strings.HasSuffix(strings.Split(url, "?")[0], ".css")
+}
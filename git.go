@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a8m/mark"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/orcaman/concurrent-map"
+)
+
+// gitProvider renders the Markdown files of a git repository, each one
+// becoming a page at the same path under root, with the other files
+// copied as they are. repositories are kept as bare mirrors in
+// gitMirrorsDir, so each publish only fetches what changed.
+type gitProvider struct{}
+
+var gitMirrorsDir = func() string {
+	dir := os.Getenv("GIT_MIRRORS_DIR")
+	if dir == "" {
+		dir = "git-mirrors"
+	}
+	return dir
+}()
+
+const gitTimeout = 5 * time.Minute
+
+type gitData struct {
+	URL          string `json:"url"`
+	Branch       string `json:"branch"`
+	Subdirectory string `json:"subdirectory"`
+}
+
+var gitFields = []field{
+	{"url", "string", true},
+	{"branch", "string", false},
+	{"subdirectory", "string", false},
+}
+
+// only remote repositories, never paths or file:// urls, which would let
+// anyone publish what is in this server.
+var gitRemote = regexp.MustCompile(`^((https?|git|ssh)://[^/]+/|[\w.-]+@[\w.-]+:)`)
+
+func (p gitProvider) Validate(data types.JSONText) FieldErrors {
+	errs := validateFields(gitFields, data)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	var d gitData
+	data.Unmarshal(&d)
+	if !gitRemote.MatchString(d.URL) {
+		errs = append(errs, FieldError{"url", "must be an http, https, git or ssh repository url"})
+	}
+	if strings.HasPrefix(d.Branch, "-") {
+		errs = append(errs, FieldError{"branch", "is not a valid branch name"})
+	}
+	if _, err := cleanSubdirectory(d.Subdirectory); err != nil {
+		errs = append(errs, FieldError{"subdirectory", err.Error()})
+	}
+	return errs
+}
+
+// Paths doesn't include the pages of each file, as their names are only
+// known after fetching them.
+func (p gitProvider) Paths(root string, data types.JSONText) []string {
+	return []string{root}
+}
+
+func (p gitProvider) Render(source Source) (pages []Page, files []File, err error) {
+	// the url ends up in a git command, so never trust it was validated
+	// when the source was saved
+	if errs := p.Validate(source.Data); len(errs) > 0 {
+		err = errs
+		return
+	}
+
+	var d gitData
+	err = source.Data.Unmarshal(&d)
+	if err != nil {
+		return
+	}
+	subdirectory, err := cleanSubdirectory(d.Subdirectory)
+	if err != nil {
+		return
+	}
+
+	archive, err := gitArchive(d.URL, d.Branch, subdirectory)
+	if err != nil {
+		return
+	}
+
+	root := normalizeRoot(source.Root)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := strings.TrimPrefix(header.Name, subdirectory)
+		if hiddenPath(name) {
+			continue
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ext := strings.ToLower(path.Ext(name))
+		if ext != ".md" && ext != ".markdown" {
+			files = append(files, File{Path: root + name, Data: contents})
+			continue
+		}
+
+		meta, markdown := frontMatter(string(contents))
+		page := Page{
+			Path:    root + markdownPagePath(name),
+			Title:   meta["title"],
+			Content: template.HTML(mark.Render(markdown)),
+		}
+		if page.Title == "" {
+			page.Title = strings.TrimSuffix(path.Base(name), path.Ext(name))
+		}
+		pages = append(pages, page)
+	}
+	return pages, files, nil
+}
+
+// markdownPagePath is where the page of a markdown file goes: docs/intro.md
+// at docs/intro/, docs/index.md and docs/README.md at docs/.
+func markdownPagePath(name string) string {
+	dir, base := path.Split(name)
+	base = strings.TrimSuffix(base, path.Ext(base))
+	switch strings.ToLower(base) {
+	case "index", "readme":
+		return dir
+	}
+	return dir + base + "/"
+}
+
+func hiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanSubdirectory returns subdirectory as "docs/" or "" for the whole
+// repository.
+func cleanSubdirectory(subdirectory string) (string, error) {
+	clean := path.Clean("/" + subdirectory)
+	if strings.Contains(subdirectory, "..") {
+		return "", errors.New("must be inside the repository")
+	}
+	if clean == "/" {
+		return "", nil
+	}
+	return clean[1:] + "/", nil
+}
+
+// gitArchive updates the mirror of a repository and returns a tar with
+// the files under subdirectory in branch, or in the default branch.
+func gitArchive(url, branch, subdirectory string) ([]byte, error) {
+	hash := sha1.Sum([]byte(url))
+	mirror, err := filepath.Abs(filepath.Join(gitMirrorsDir, hex.EncodeToString(hash[:])))
+	if err != nil {
+		return nil, err
+	}
+
+	// git doesn't like two fetches on the same repository at once
+	unlock := lockGitMirror(mirror)
+	defer unlock()
+
+	if _, err := os.Stat(mirror); os.IsNotExist(err) {
+		err = os.MkdirAll(gitMirrorsDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		_, err = runGit("", "clone", "--mirror", "--", url, mirror)
+		if err != nil {
+			os.RemoveAll(mirror)
+			return nil, err
+		}
+	} else {
+		_, err = runGit(mirror, "remote", "update", "--prune")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ref := "HEAD"
+	if branch != "" {
+		ref = "refs/heads/" + branch
+	}
+	args := []string{"archive", "--format=tar", ref}
+	if subdirectory != "" {
+		args = append(args, "--", subdirectory)
+	}
+	return runGit(mirror, args...)
+}
+
+func runGit(gitDir string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	command := args[0]
+	if gitDir != "" {
+		args = append([]string{"--git-dir=" + gitDir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("git " + command + ": " + err.Error() +
+			": " + strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+var gitMirrorLocks = cmap.New()
+
+func lockGitMirror(mirror string) func() {
+	gitMirrorLocks.SetIfAbsent(mirror, &sync.Mutex{})
+	imu, _ := gitMirrorLocks.Get(mirror)
+	mu := imu.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
@@ -47,6 +47,11 @@ func trelloInstantSite(pg *sqlx.DB, w http.ResponseWriter, r *http.Request) {
 	if err == nil && len(sources) == 0 {
 		err = errors.New("zero sources received.")
 	}
+	if err == nil {
+		if errs := validateSource(sources[0]); len(errs) > 0 {
+			err = errs
+		}
+	}
 	if err != nil {
 		http.Error(w, "wrong site.sources: "+err.Error(), 400)
 		return
@@ -87,11 +92,24 @@ func trelloInstantSite(pg *sqlx.DB, w http.ResponseWriter, r *http.Request) {
 	}
 	user := userData.Username + "@trello"
 
-	siteId, err := createSite(pg, user, site.Domain)
+	siteId, claim, err := claimDomain(pg, user, site.Domain)
+	if err == ErrDomainTaken {
+		http.Error(w, "failed to create site: "+err.Error(), 409)
+		return
+	}
+	if err == ErrDomainReserved {
+		http.Error(w, "failed to create site: "+err.Error(), 400)
+		return
+	}
 	if err != nil {
 		http.Error(w, "failed to create site: "+err.Error(), 500)
 		return
 	}
+	if claim != nil {
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(claim)
+		return
+	}
 
 	_, err = updateSiteData(pg, user, siteId, site.Data)
 	if err != nil {
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// each site can be republished by hitting /hook/{site}/{token}. anyone with
+// the url can trigger it, so the token is secret. when the call comes from
+// trello we also check its signature.
+
+var trelloSecret = os.Getenv("TRELLO_SECRET")
+
+func siteHookURL(pg *sqlx.DB, user string, siteId int, reset bool) (url string, err error) {
+	b := make([]byte, 20)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+
+	var token string
+	err = pg.Get(&token, `
+UPDATE sites SET hook_token = CASE WHEN $3 OR hook_token IS NULL
+  THEN $4 ELSE hook_token
+END
+WHERE owner = $1 AND id = $2
+RETURNING hook_token
+    `, user, siteId, reset, hex.EncodeToString(b))
+	if err != nil {
+		return
+	}
+
+	return serviceURL + "/hook/" + strconv.Itoa(siteId) + "/" + token, nil
+}
+
+func siteHook(pg *sqlx.DB, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/hook/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	siteId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var token string
+	err = pg.Get(&token, `
+SELECT coalesce(hook_token, '') FROM sites WHERE id = $1
+    `, siteId)
+	if err != nil || !validHookToken(token, parts[1]) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		// trello checks the url exists before creating the webhook
+		w.WriteHeader(200)
+		return
+	case "GET":
+		// dropbox wants its challenge echoed back
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write([]byte(r.URL.Query().Get("challenge")))
+		return
+	case "POST":
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if signature := r.Header.Get("X-Trello-Webhook"); signature != "" {
+		if !validTrelloSignature(signature, body, serviceURL+r.URL.Path) {
+			log.Warn().
+				Int("site", siteId).
+				Msg("hook called with an invalid trello signature")
+			http.Error(w, "invalid signature", 401)
+			return
+		}
+	}
+
+	job, err := enqueueSitePublish(pg, siteId, "webhook")
+	if err != nil {
+		log.Error().
+			Err(err).
+			Int("site", siteId).
+			Msg("couldn't enqueue publish from hook")
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Info().
+		Int("site", siteId).
+		Int("job", job.Id).
+		Msg("publish requested by hook")
+	w.WriteHeader(200)
+}
+
+// validHookToken tells if given is the token of the site, those without
+// one have no hook.
+func validHookToken(token, given string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(given)) == 1
+}
+
+// validTrelloSignature checks the signature trello sends, which is the
+// HMAC-SHA1 of the request body followed by the callback url, keyed with
+// our trello app secret.
+func validTrelloSignature(signature string, body []byte, callbackURL string) bool {
+	if trelloSecret == "" {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, []byte(trelloSecret))
+	mac.Write(body)
+	mac.Write([]byte(callbackURL))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
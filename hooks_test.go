@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+)
+
+func TestValidHookToken(t *testing.T) {
+	for _, test := range []struct {
+		token string
+		given string
+		valid bool
+	}{
+		{"abc123", "abc123", true},
+		{"abc123", "abc124", false},
+		{"abc123", "abc12", false},
+		{"abc123", "", false},
+		{"", "", false},
+	} {
+		if validHookToken(test.token, test.given) != test.valid {
+			t.Errorf("token %q given %q wasn't valid %v", test.token, test.given, test.valid)
+		}
+	}
+}
+
+func TestValidTrelloSignature(t *testing.T) {
+	defer func(s string) { trelloSecret = s }(trelloSecret)
+	trelloSecret = "secret"
+
+	body := []byte(`{"action": {"type": "updateCard"}}`)
+	callbackURL := "https://app.sitios.xyz/hook/12/abc123"
+
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write(body)
+	mac.Write([]byte(callbackURL))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	for _, test := range []struct {
+		name        string
+		signature   string
+		body        []byte
+		callbackURL string
+		valid       bool
+	}{
+		{"signed", signature, body, callbackURL, true},
+		{"tampered body", signature, []byte(`{"action": {"type": "deleteCard"}}`), callbackURL, false},
+		{"other hook", signature, body, "https://app.sitios.xyz/hook/12/abc124", false},
+		{"no signature", "", body, callbackURL, false},
+	} {
+		if validTrelloSignature(test.signature, test.body, test.callbackURL) != test.valid {
+			t.Errorf("%s: signature wasn't valid %v", test.name, test.valid)
+		}
+	}
+
+	// nothing is valid without our secret
+	trelloSecret = ""
+	if validTrelloSignature(signature, body, callbackURL) {
+		t.Error("signature was valid without a secret")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// publish jobs live in postgres, so they survive restarts and the client
+// can ask for their state at any time. each site has at most one queued
+// job and the workers never run two jobs for the same site at once.
+
+type PublishJob struct {
+	Id         int        `db:"id" json:"id"`
+	Site       int        `db:"site" json:"site"`
+	State      string     `db:"state" json:"state"`
+	Origin     string     `db:"origin" json:"origin"`
+	Error      string     `db:"error" json:"error,omitempty"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	StartedAt  *time.Time `db:"started_at" json:"started_at"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+
+	owner string
+}
+
+const jobFields = `
+  publish_jobs.id, publish_jobs.site, publish_jobs.state, publish_jobs.origin,
+  publish_jobs.error,
+  publish_jobs.created_at, publish_jobs.started_at, publish_jobs.finished_at
+`
+
+var jobsWakeup = make(chan struct{}, 1)
+
+// enqueuePublish queues a publish requested by the owner of the site.
+func enqueuePublish(pg *sqlx.DB, user string, siteId int) (PublishJob, error) {
+	return insertPublishJob(pg, `
+SELECT id, 'manual' FROM sites WHERE owner = $1 AND id = $2
+    `, user, siteId)
+}
+
+// enqueueSitePublish queues a publish not requested by anyone in
+// particular, origin tells what caused it.
+func enqueueSitePublish(pg *sqlx.DB, siteId int, origin string) (PublishJob, error) {
+	return insertPublishJob(pg, `
+SELECT id, $2 FROM sites WHERE id = $1
+    `, siteId, origin)
+}
+
+// insertPublishJob inserts a job for the (site, origin) row returned by
+// query. if the site already has a queued job that one is returned instead.
+func insertPublishJob(pg *sqlx.DB, query string, args ...interface{}) (job PublishJob, err error) {
+	err = pg.Get(&job, `
+INSERT INTO publish_jobs (site, origin)
+`+query+`
+ON CONFLICT (site) WHERE state = 'queued' DO UPDATE SET site = excluded.site
+RETURNING `+jobFields, args...)
+	if err != nil {
+		return
+	}
+
+	wakePublishWorkers()
+	return
+}
+
+func wakePublishWorkers() {
+	select {
+	case jobsWakeup <- struct{}{}:
+	default:
+	}
+}
+
+func fetchPublishJob(pg *sqlx.DB, user string, jobId int) (job PublishJob, err error) {
+	err = pg.Get(&job, `
+SELECT `+jobFields+`
+FROM publish_jobs
+INNER JOIN sites ON sites.id = publish_jobs.site
+WHERE sites.owner = $1 AND publish_jobs.id = $2
+    `, user, jobId)
+	return
+}
+
+func fetchLatestPublishJob(pg *sqlx.DB, user string, siteId int) (job PublishJob, err error) {
+	err = pg.Get(&job, `
+SELECT `+jobFields+`
+FROM publish_jobs
+INNER JOIN sites ON sites.id = publish_jobs.site
+WHERE sites.owner = $1 AND sites.id = $2
+ORDER BY publish_jobs.id DESC
+LIMIT 1
+    `, user, siteId)
+	return
+}
+
+func claimPublishJob(pg *sqlx.DB) (job PublishJob, err error) {
+	row := pg.QueryRowx(`
+UPDATE publish_jobs SET state = 'running', started_at = now()
+WHERE id = (
+  SELECT id FROM publish_jobs
+  WHERE state = 'queued'
+    AND site NOT IN (SELECT site FROM publish_jobs WHERE state = 'running')
+  ORDER BY id
+  LIMIT 1
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING ` + jobFields + `,
+  (SELECT owner FROM sites WHERE sites.id = publish_jobs.site)
+    `)
+	err = row.Scan(&job.Id, &job.Site, &job.State, &job.Origin, &job.Error,
+		&job.CreatedAt, &job.StartedAt, &job.FinishedAt, &job.owner)
+	return
+}
+
+func finishPublishJob(pg *sqlx.DB, jobId int, jobErr error) error {
+	state := "succeeded"
+	message := ""
+	if jobErr != nil {
+		state = "failed"
+		message = jobErr.Error()
+	}
+
+	_, err := pg.Exec(`
+UPDATE publish_jobs SET state = $2, error = $3, finished_at = now()
+WHERE id = $1
+    `, jobId, state, message)
+	return err
+}
+
+// requeueInterruptedJobs puts back in the queue the jobs that were running
+// when the server last stopped, unless their sites already have another
+// job waiting, in which case they're just marked as failed.
+func requeueInterruptedJobs(pg *sqlx.DB) error {
+	_, err := pg.Exec(`
+UPDATE publish_jobs SET state = 'queued', started_at = NULL
+WHERE state = 'running'
+  AND site NOT IN (SELECT site FROM publish_jobs WHERE state = 'queued')
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = pg.Exec(`
+UPDATE publish_jobs
+SET state = 'failed', error = 'interrupted by server restart', finished_at = now()
+WHERE state = 'running'
+    `)
+	return err
+}
+
+func startPublishWorkers(pg *sqlx.DB) {
+	n := envInt("PUBLISH_WORKERS", 2)
+
+	err := requeueInterruptedJobs(pg)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("failed to requeue interrupted publish jobs")
+	}
+	err = requeuePreviews(pg)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("failed to requeue interrupted previews")
+	}
+
+	for i := 0; i < n; i++ {
+		go publishWorker(pg)
+	}
+}
+
+// publishWorker also builds the previews, when there is nothing to publish.
+func publishWorker(pg *sqlx.DB) {
+	for {
+		job, err := claimPublishJob(pg)
+		if err == sql.ErrNoRows {
+			var site Site
+			var owner string
+			site, owner, err = claimPreview(pg)
+			if err == nil {
+				runPreview(pg, site, owner)
+				continue
+			}
+		}
+		if err == sql.ErrNoRows {
+			select {
+			case <-jobsWakeup:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("failed to claim publish job")
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		err = runPublishJob(pg, job)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Int("job", job.Id).
+				Int("site", job.Site).
+				Msg("publish job failed")
+		}
+
+		err = finishPublishJob(pg, job.Id, err)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Int("job", job.Id).
+				Msg("failed to save publish job result")
+		}
+
+		// another job for this same site may be waiting for this one
+		wakePublishWorkers()
+	}
+}
+
+func runPublishJob(pg *sqlx.DB, job PublishJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while publishing: %v", r)
+		}
+	}()
+
+	site, err := fetchSite(pg, job.owner, job.Site)
+	if err != nil {
+		return err
+	}
+
+	return publish(site, userConnection(job.owner))
+}
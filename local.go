@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localStorage stores each site in a directory inside dir. versions are
+// kept in dir/.versions/{domain}/{version} and dir/{domain} is a symlink
+// to the live one, replaced atomically on each activation. domains that
+// redirect to others have a file with the other domain in
+// dir/.redirects/{domain}.
+type localStorage struct {
+	dir string
+}
+
+// target is the path from where the site is served.
+func (l localStorage) target(domain string) (string, error) {
+	if err := validDomain(domain); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.dir, domain), nil
+}
+
+func (l localStorage) versionsDir(domain string) string {
+	return filepath.Join(l.dir, ".versions", domain)
+}
+
+func (l localStorage) redirectFile(domain string) string {
+	return filepath.Join(l.dir, ".redirects", domain)
+}
+
+func (l localStorage) EnsureTarget(domain string) error {
+	if err := validDomain(domain); err != nil {
+		return err
+	}
+	os.Remove(l.redirectFile(domain))
+	return os.MkdirAll(l.versionsDir(domain), 0755)
+}
+
+func (l localStorage) RemoveTarget(domain string) error {
+	target, err := l.target(domain)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+	os.Remove(l.redirectFile(domain))
+	return os.RemoveAll(l.versionsDir(domain))
+}
+
+func (l localStorage) MoveTarget(from, to string) error {
+	fromTarget, err := l.target(from)
+	if err != nil {
+		return err
+	}
+	toTarget, err := l.target(to)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(toTarget); err == nil {
+		return errors.New(to + " already has files")
+	}
+	os.Remove(l.redirectFile(to))
+
+	// the live version, after moving a site published before we had
+	// versions to the oldest one
+	live := ""
+	if info, err := os.Lstat(fromTarget); err == nil && info.IsDir() {
+		err = os.MkdirAll(l.versionsDir(from), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(fromTarget, filepath.Join(l.versionsDir(from), "0"))
+		if err != nil {
+			return err
+		}
+		live = "0"
+	} else if link, err := os.Readlink(fromTarget); err == nil {
+		live = filepath.Base(link)
+	}
+
+	err = os.RemoveAll(l.versionsDir(to))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.versionsDir(from), l.versionsDir(to))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(fromTarget)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if live == "" {
+		return nil
+	}
+	return l.Activate(to, live)
+}
+
+func (l localStorage) Redirect(from, to string) error {
+	if err := validDomain(to); err != nil {
+		return err
+	}
+	err := l.RemoveTarget(from)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(l.redirectFile(from)), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.redirectFile(from), []byte(to), 0644)
+}
+
+func (l localStorage) Targets() (targets []string, err error) {
+	entries, err := ioutil.ReadDir(filepath.Join(l.dir, ".versions"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			targets = append(targets, entry.Name())
+		}
+	}
+
+	redirects, err := ioutil.ReadDir(filepath.Join(l.dir, ".redirects"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range redirects {
+		targets = append(targets, entry.Name())
+	}
+	return targets, nil
+}
+
+func (l localStorage) UploadTree(domain, version, dirname string) (UploadResult, error) {
+	target, err := l.target(domain)
+	if err != nil {
+		return UploadResult{}, err
+	}
+	dst := filepath.Join(l.versionsDir(domain), version)
+
+	// the live version, if there is one
+	live, err := filepath.EvalSymlinks(target)
+	if err != nil && !os.IsNotExist(err) {
+		return UploadResult{}, err
+	}
+
+	result, err := uploadTree(dirname, func(file treeFile) (uploadOutcome, error) {
+		key := filepath.FromSlash(file.key)
+		if live == "" {
+			return uploadAdded, copyFile(file.path, filepath.Join(dst, key))
+		}
+
+		exists, same, err := sameContents(file.path, filepath.Join(live, key))
+		if err != nil {
+			return 0, err
+		}
+		if same {
+			return uploadUnchanged,
+				linkFile(filepath.Join(live, key), filepath.Join(dst, key))
+		}
+
+		err = copyFile(file.path, filepath.Join(dst, key))
+		if err != nil {
+			return 0, err
+		}
+
+		if exists {
+			return uploadChanged, nil
+		}
+		return uploadAdded, nil
+	})
+
+	if live != "" {
+		liveFiles, _ := listTree(live)
+		for _, file := range liveFiles {
+			if !result.Keys[file.key] {
+				result.Removed++
+			}
+		}
+	}
+	return result, err
+}
+
+func (l localStorage) Activate(domain, version string) error {
+	target, err := l.target(domain)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(l.versionsDir(domain), version)); err != nil {
+		return errors.New("version " + version + " not found")
+	}
+
+	// sites published before we had versions are directories, keep
+	// them as the oldest version so we can replace them with a link.
+	if info, err := os.Lstat(target); err == nil && info.IsDir() {
+		err = os.Rename(target, filepath.Join(l.versionsDir(domain), "0"))
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp := filepath.Join(l.versionsDir(domain), ".live")
+	os.Remove(tmp)
+	err = os.Symlink(filepath.Join(".versions", domain, version), tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+func (l localStorage) Versions(domain string) (versions []string, err error) {
+	if err := validDomain(domain); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(l.versionsDir(domain))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			versions = append(versions, entry.Name())
+		}
+	}
+	return
+}
+
+func (l localStorage) ReadLive(domain, key string) (io.ReadCloser, error) {
+	target, err := l.target(domain)
+	if err != nil {
+		return nil, err
+	}
+	filename, err := sitePath(target, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
+}
+
+func (l localStorage) RemoveVersion(domain, version string) error {
+	if err := validDomain(domain); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(l.versionsDir(domain), version))
+}
+
+// CNAMETarget is this server itself, since sites stored here are served
+// by siteServer.
+func (l localStorage) CNAMETarget() string {
+	return serviceHostname()
+}
+
+// sameContents tells if dst exists and has the same contents as src.
+func sameContents(src, dst string) (exists bool, same bool, err error) {
+	dstInfo, err := os.Stat(dst)
+	if os.IsNotExist(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return true, false, err
+	}
+	if srcInfo.Size() != dstInfo.Size() {
+		return true, false, nil
+	}
+
+	srcHash, err := fileMD5(src)
+	if err != nil {
+		return true, false, err
+	}
+	dstHash, err := fileMD5(dst)
+	if err != nil {
+		return true, false, err
+	}
+	return true, srcHash == dstHash, nil
+}
+
+// linkFile makes dst point to the same file as src, copying it if a hard
+// link can't be made. files are never modified in place, so both can be
+// shared by many versions.
+func linkFile(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile writes src to dst through a temporary file, so readers never
+// see a partially written dst.
+func copyFile(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// a name of its own, so copies to the same dst don't write over each
+	// other before being renamed
+	out, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	_, err = io.Copy(out, in)
+	if err == nil {
+		// as os.Create would
+		err = out.Chmod(0644)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeTree(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "sitios-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func readLive(t *testing.T, l localStorage, domain, key string) string {
+	r, err := l.ReadLive(domain, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLocalStorageVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sitios-sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := localStorage{dir: dir}
+
+	first := writeTree(t, map[string]string{
+		"index.html":       "home",
+		"posts/index.html": "posts",
+	})
+	defer os.RemoveAll(first)
+	second := writeTree(t, map[string]string{
+		"index.html":       "new home",
+		"posts/index.html": "posts",
+		"about/index.html": "about",
+	})
+	defer os.RemoveAll(second)
+
+	if err := l.EnsureTarget("a.com"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := l.UploadTree("a.com", "1", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 2 {
+		t.Errorf("first upload added %d files, not 2", result.Added)
+	}
+	if err := l.Activate("a.com", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if live := readLive(t, l, "a.com", "index.html"); live != "home" {
+		t.Errorf("serving %q after activating 1", live)
+	}
+
+	result, err = l.UploadTree("a.com", "2", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 1 || result.Changed != 1 || result.Unchanged != 1 {
+		t.Errorf("second upload: %+v", result)
+	}
+	// uploading doesn't change what is served
+	if live := readLive(t, l, "a.com", "index.html"); live != "home" {
+		t.Errorf("serving %q before activating 2", live)
+	}
+	if err := l.Activate("a.com", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if live := readLive(t, l, "a.com", "about/index.html"); live != "about" {
+		t.Errorf("serving %q after activating 2", live)
+	}
+
+	// rolling back
+	if err := l.Activate("a.com", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if live := readLive(t, l, "a.com", "index.html"); live != "home" {
+		t.Errorf("serving %q after rolling back to 1", live)
+	}
+	if _, err := l.ReadLive("a.com", "about/index.html"); err == nil {
+		t.Error("a file only in 2 is still served after rolling back to 1")
+	}
+
+	versions, err := l.Versions("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(versions)
+	if len(versions) != 2 || versions[0] != "1" || versions[1] != "2" {
+		t.Errorf("versions are %v", versions)
+	}
+
+	if err := l.Activate("a.com", "3"); err == nil {
+		t.Error("activated a version that doesn't exist")
+	}
+	if live := readLive(t, l, "a.com", "index.html"); live != "home" {
+		t.Errorf("serving %q after failing to activate 3", live)
+	}
+
+	if err := l.RemoveTarget("a.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.ReadLive("a.com", "index.html"); err == nil {
+		t.Error("still serving after removing the target")
+	}
+}
+
+func TestLocalStorageInvalidDomains(t *testing.T) {
+	l := localStorage{dir: "sites"}
+	for _, domain := range []string{"", ".versions", "../etc", "a/b"} {
+		if err := l.EnsureTarget(domain); err == nil {
+			t.Errorf("accepted %q", domain)
+		}
+	}
+}
+
+func TestCopyFileConcurrently(t *testing.T) {
+	tree := writeTree(t, map[string]string{
+		"a.html": strings.Repeat("a", 1<<20),
+		"b.html": strings.Repeat("b", 1<<20),
+	})
+	defer os.RemoveAll(tree)
+	dst := filepath.Join(tree, "out", "index.html")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		src := filepath.Join(tree, []string{"a.html", "b.html"}[i%2])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := copyFile(src, dst); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != strings.Repeat("a", 1<<20) && string(b) != strings.Repeat("b", 1<<20) {
+		t.Errorf("copies were mixed up")
+	}
+	if names, _ := filepath.Glob(filepath.Join(tree, "out", "*")); len(names) != 1 {
+		t.Errorf("left %v behind", names)
+	}
+	if names, _ := filepath.Glob(filepath.Join(tree, "out", ".*")); len(names) != 0 {
+		t.Errorf("left %v behind", names)
+	}
+}
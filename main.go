@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fiatjaf/accountd"
@@ -31,12 +33,21 @@ func main() {
 			Msg("error connecting to postgres")
 	}
 
+	startPublishWorkers(pg)
+	startScheduler(pg)
+	startPreviewJanitor(pg)
+	startReconciler(pg)
+
 	http.HandleFunc("/trello-list-id", trelloListIdHandle)
 	http.HandleFunc("/trello", onboardTrello)
 	http.HandleFunc("/trello/instant-site", func(w http.ResponseWriter, r *http.Request) {
 		trelloInstantSite(pg, w, r)
 	})
 
+	http.HandleFunc("/hook/", func(w http.ResponseWriter, r *http.Request) {
+		siteHook(pg, w, r)
+	})
+
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		conn, err := websocket.Upgrade(w, r, w.Header(), 1024, 1024)
 		if err != nil {
@@ -89,7 +100,15 @@ func main() {
 			http.Error(w, err.Error(), 400)
 		}
 
-		id, err := createSite(pg, user, data.Domain)
+		id, claim, err := claimDomain(pg, user, data.Domain)
+		if err == ErrDomainTaken {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err == ErrDomainReserved {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 		if err != nil {
 			log.Error().
 				Err(err).
@@ -99,6 +118,12 @@ func main() {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		if claim != nil {
+			// the client must ask again once the TXT record is there
+			w.WriteHeader(202)
+			json.NewEncoder(w).Encode(claim)
+			return
+		}
 		json.NewEncoder(w).Encode(id)
 	})
 	http.HandleFunc("/get-site", func(w http.ResponseWriter, r *http.Request) {
@@ -151,6 +176,119 @@ func main() {
 
 		json.NewEncoder(w).Encode(site)
 	})
+	http.HandleFunc("/rename-site", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var data struct {
+			Id       int    `json:"id"`
+			Domain   string `json:"domain"`
+			Redirect bool   `json:"redirect"` // keep the old domain redirecting
+		}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		site, claim, err := renameSite(pg, user, data.Id, data.Domain, data.Redirect)
+		if err == ErrDomainTaken {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err == ErrDomainReserved {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err == ErrSiteMoved {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", data.Id).
+				Str("domain", data.Domain).
+				Msg("couldn't rename site")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if claim != nil {
+			// the client must ask again once the TXT record is there
+			w.WriteHeader(202)
+			json.NewEncoder(w).Encode(claim)
+			return
+		}
+		json.NewEncoder(w).Encode(site)
+	})
+	http.HandleFunc("/update-site-generator", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var site Site
+		err := json.NewDecoder(r.Body).Decode(&site)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+
+		if site.Generator != "sitio" && site.Generator != "native" {
+			http.Error(w, "generator must be either sitio or native.", 400)
+			return
+		}
+
+		site, err = updateSiteGenerator(pg, user, site.Id, site.Generator)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", site.Id).
+				Msg("couldn't update site generator")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		json.NewEncoder(w).Encode(site)
+	})
+	http.HandleFunc("/update-site-schedule", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var site Site
+		err := json.NewDecoder(r.Body).Decode(&site)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+
+		// a null or zero publish_every disables automatic publishing
+		if site.PublishEvery != nil && *site.PublishEvery == 0 {
+			site.PublishEvery = nil
+		}
+		if site.PublishEvery != nil && *site.PublishEvery < minPublishEvery {
+			http.Error(w, "sites can't be published automatically more than once every "+
+				strconv.Itoa(minPublishEvery)+" minutes.", 400)
+			return
+		}
+
+		site, err = updateSiteSchedule(pg, user, site.Id, site.PublishEvery)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", site.Id).
+				Msg("couldn't update site schedule")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		json.NewEncoder(w).Encode(site)
+	})
 	http.HandleFunc("/delete-site", func(w http.ResponseWriter, r *http.Request) {
 		user, ok := auth(r, w, false)
 		if !ok {
@@ -174,12 +312,22 @@ func main() {
 			return
 		}
 
-		err = removeBucket(site.Domain)
+		err = removePreview(pg, site.Id)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Int("site", site.Id).
+				Msg("couldn't remove preview on delete-site")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		err = storage.RemoveTarget(site.Domain)
 		if err != nil {
 			log.Error().
 				Err(err).
 				Str("domain", site.Domain).
-				Msg("couldn't delete bucket on delete-site")
+				Msg("couldn't remove site storage on delete-site")
 			http.Error(w, err.Error(), 500)
 			return
 		}
@@ -196,6 +344,30 @@ func main() {
 			}
 		}
 
+		redirects, err := siteRedirects(pg, site.Id)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Int("site", site.Id).
+				Msg("couldn't list redirects on delete-site")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		for _, domain := range redirects {
+			err = storage.RemoveTarget(domain)
+			if err == nil && !isCustomDomain(domain) {
+				err = removeSubdomainDNS(domain)
+			}
+			if err != nil {
+				log.Error().
+					Err(err).
+					Str("domain", domain).
+					Msg("couldn't remove redirect on delete-site")
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+
 		err = deleteSite(pg, user, site.Id)
 		if err != nil {
 			log.Error().
@@ -206,8 +378,41 @@ func main() {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+
+		err = os.RemoveAll(siteUploadsDir(site.Id))
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Int("site", site.Id).
+				Msg("couldn't remove uploaded files on delete-site")
+		}
 		w.WriteHeader(200)
 	})
+	http.HandleFunc("/verify-domain", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var site Site
+		err := json.NewDecoder(r.Body).Decode(&site)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		check, err := verifyDomain(pg, user, site.Id)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", site.Id).
+				Msg("couldn't verify domain")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(check)
+	})
 	http.HandleFunc("/add-source", func(w http.ResponseWriter, r *http.Request) {
 		user, ok := auth(r, w, false)
 		if !ok {
@@ -245,6 +450,10 @@ func main() {
 		}
 
 		site, err := updateSource(pg, user, source)
+		if errs, invalid := err.(FieldErrors); invalid {
+			writeFieldErrors(w, errs)
+			return
+		}
 		if err != nil {
 			log.Error().
 				Err(err).
@@ -256,6 +465,38 @@ func main() {
 		}
 		json.NewEncoder(w).Encode(site)
 	})
+	http.HandleFunc("/reorder-sources", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var data struct {
+			Id      int   `json:"id"`
+			Sources []int `json:"sources"` // source ids in the new order
+		}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		site, err := reorderSources(pg, user, data.Id, data.Sources)
+		if err == ErrIncompleteOrder {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", data.Id).
+				Msg("couldn't reorder sources")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(site)
+	})
 	http.HandleFunc("/delete-source", func(w http.ResponseWriter, r *http.Request) {
 		user, ok := auth(r, w, false)
 		if !ok {
@@ -278,8 +519,111 @@ func main() {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+
+		err = os.RemoveAll(sourceUploadsDir(site.Id, source.Id))
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Int("source", source.Id).
+				Msg("couldn't remove uploaded files on delete-source")
+		}
 		json.NewEncoder(w).Encode(site)
 	})
+	http.HandleFunc("/upload-file", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		// a multipart form with the source id, the file and optionally the
+		// name it should have, otherwise its own name is used.
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+		sourceId, _ := strconv.Atoi(r.FormValue("source"))
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		defer file.Close()
+		if header.Size > maxUploadSize {
+			http.Error(w, "file is too big", 413)
+			return
+		}
+		name := r.FormValue("name")
+		if name == "" {
+			name = header.Filename
+		}
+
+		upload, err := saveUpload(pg, user, sourceId, name, file)
+		if err == ErrNotUploadSource {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("source", sourceId).
+				Str("name", name).
+				Msg("couldn't save upload")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(upload)
+	})
+	http.HandleFunc("/list-uploads", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var source Source
+		err := json.NewDecoder(r.Body).Decode(&source)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		uploads, err := listUploads(pg, user, source.Id)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("source", source.Id).
+				Msg("couldn't list uploads")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if uploads == nil {
+			uploads = []Upload{}
+		}
+		json.NewEncoder(w).Encode(uploads)
+	})
+	http.HandleFunc("/delete-upload", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var upload Upload
+		err := json.NewDecoder(r.Body).Decode(&upload)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		err = removeUpload(pg, user, upload.Id)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("upload", upload.Id).
+				Msg("couldn't remove upload")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(200)
+	})
 	http.HandleFunc("/publish", func(w http.ResponseWriter, r *http.Request) {
 		user, ok := auth(r, w, false)
 		if !ok {
@@ -292,48 +636,206 @@ func main() {
 			http.Error(w, err.Error(), 400)
 		}
 
-		site, err = fetchSite(pg, user, site.Id)
+		job, err := enqueuePublish(pg, user, site.Id)
 		if err != nil {
 			log.Error().
 				Err(err).
 				Str("user", user).
 				Int("site", site.Id).
-				Msg("couldn't fetch site")
+				Msg("couldn't enqueue publish job")
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		json.NewEncoder(w).Encode(job)
+	})
+	http.HandleFunc("/publish-status", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
 
-		var conn *websocket.Conn
-		iconn, ok := connections.Get(user)
-		if ok {
-			conn, ok = iconn.(*websocket.Conn)
+		// either a job id or a site id, in which case we return the
+		// latest job for that site.
+		var data struct {
+			Id   int `json:"id"`
+			Site int `json:"site"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
 		}
 
-		if conn == nil {
+		var job PublishJob
+		if data.Id != 0 {
+			job, err = fetchPublishJob(pg, user, data.Id)
+		} else {
+			job, err = fetchLatestPublishJob(pg, user, data.Site)
+		}
+		if err != nil {
 			log.Error().
 				Err(err).
 				Str("user", user).
-				Msg("need a valid websocket connection when publishing.")
-			http.Error(w, err.Error(), 403)
+				Int("job", data.Id).
+				Int("site", data.Site).
+				Msg("couldn't fetch publish job")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+	})
+	http.HandleFunc("/preview", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
 			return
 		}
 
+		// data and sources, if present, are used instead of the saved ones
+		var site Site
+		err := json.NewDecoder(r.Body).Decode(&site)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		preview, err := startPreview(pg, user, site)
+		if errs, invalid := err.(FieldErrors); invalid {
+			writeFieldErrors(w, errs)
+			return
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", site.Id).
+				Msg("couldn't start preview")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(preview)
+	})
+	http.HandleFunc("/preview-status", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var site Site
+		err := json.NewDecoder(r.Body).Decode(&site)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+
+		preview, err := fetchPreview(pg, user, site.Id)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", site.Id).
+				Msg("couldn't fetch preview")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(preview)
+	})
+	http.HandleFunc("/rollback", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var data struct {
+			Id    int `json:"id"`
+			Build int `json:"build"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+
+		site, err := fetchSite(pg, user, data.Id)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", data.Id).
+				Msg("couldn't fetch site")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		err = rollback(site, data.Build)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Int("site", site.Id).
+				Int("build", data.Build).
+				Msg("couldn't roll back site")
+			http.Error(w, err.Error(), 500)
+			return
+		}
 		w.WriteHeader(200)
+	})
+	http.HandleFunc("/site-hook", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var data struct {
+			Id    int  `json:"id"`
+			Reset bool `json:"reset"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+
+		url, err := siteHookURL(pg, user, data.Id, data.Reset)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("user", user).
+				Int("site", data.Id).
+				Msg("couldn't get site hook url")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(url)
+	})
+	http.HandleFunc("/site-builds", func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth(r, w, false)
+		if !ok {
+			return
+		}
+
+		var site Site
+		err := json.NewDecoder(r.Body).Decode(&site)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+		}
 
-		err = publish(site, conn)
+		builds, err := listBuilds(pg, user, site.Id)
 		if err != nil {
 			log.Error().
 				Err(err).
+				Str("user", user).
 				Int("site", site.Id).
-				Msg("error publishing")
+				Msg("couldn't list builds")
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		json.NewEncoder(w).Encode(builds)
 	})
 
+	// when sites are stored locally we serve them ourselves
+	var handler http.Handler = http.DefaultServeMux
+	if local, ok := storage.(localStorage); ok {
+		handler = siteServer{dir: local.dir, next: handler}
+	}
+
 	port := os.Getenv("PORT")
 	log.Print("listening on port " + port)
-	panic(http.ListenAndServe(":"+port, nil))
+	panic(http.ListenAndServe(":"+port, handler))
 }
 
 func auth(r *http.Request, w http.ResponseWriter, rewrite bool) (user string, ok bool) {
@@ -361,8 +863,9 @@ func handle(pg *sqlx.DB, conn *websocket.Conn) {
 	defer conn.Close()
 	var user string
 	var userch = make(chan string, 1)
+	var ws = &wsconn{conn: conn}
 
-	go notLoggedNotify(conn, userch)
+	go notLoggedNotify(ws, userch)
 	for {
 		typ, bm, err := conn.ReadMessage()
 		if err != nil || typ != websocket.TextMessage {
@@ -379,7 +882,8 @@ func handle(pg *sqlx.DB, conn *websocket.Conn) {
 		switch m[0] {
 		case "login":
 			tokendata, err := acd.VerifyAuth(m[1])
-			userch <- tokendata.User.Name
+			user = tokendata.User.Name
+			userch <- user
 
 			if err != nil {
 				log.Error().
@@ -388,14 +892,37 @@ func handle(pg *sqlx.DB, conn *websocket.Conn) {
 					Msg("failed to verify auth token")
 				return
 			}
-			connections.Set(user, conn)
+			connections.Set(user, ws)
 			break
 		}
 
 	}
 }
 
-func notLoggedNotify(conn *websocket.Conn, userch chan string) {
+// wsconn guards a websocket so publishes and previews running at the same
+// time for the same user don't write to it concurrently.
+type wsconn struct {
+	sync.Mutex
+	conn *websocket.Conn
+}
+
+func (ws *wsconn) Send(message []byte) error {
+	ws.Lock()
+	defer ws.Unlock()
+	return ws.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// userConnection returns the websocket the user is logged in from, if any.
+func userConnection(user string) *wsconn {
+	if iconn, ok := connections.Get(user); ok {
+		if ws, ok := iconn.(*wsconn); ok {
+			return ws
+		}
+	}
+	return nil
+}
+
+func notLoggedNotify(ws *wsconn, userch chan string) {
 	timeout := make(chan string, 1)
 	go func() {
 		time.Sleep(1 * time.Second)
@@ -408,7 +935,7 @@ func notLoggedNotify(conn *websocket.Conn, userch chan string) {
 			return
 		}
 	case <-timeout:
-		err := conn.WriteMessage(websocket.TextMessage, []byte("not-logged"))
+		err := ws.Send([]byte("not-logged"))
 		if err != nil {
 			log.Warn().
 				Err(err).
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// each source writes its pages under its root. before saving a source and
+// before publishing we check that no two sources claim the same paths, so
+// one doesn't silently overwrite the pages of another in _site. a claimed
+// path ending in "*" stands for everything under it.
+
+// errorPagePath is where the generators put the page shown for missing
+// files, no source may write there.
+const errorPagePath = "/error/"
+
+// PathConflict is a path claimed by two sources. an empty Provider stands
+// for the site itself.
+type PathConflict struct {
+	Path        string `json:"path"`
+	Source      Source `json:"source"`
+	OtherPath   string `json:"other_path"`
+	OtherSource Source `json:"other_source"`
+}
+
+func (c PathConflict) String() string {
+	return c.Path + " of " + describeSource(c.Source) +
+		" overlaps " + c.OtherPath + " of " + describeSource(c.OtherSource)
+}
+
+func describeSource(source Source) string {
+	if source.Provider == "" {
+		return "the error page"
+	}
+	return source.Provider + " on " + normalizeRoot(source.Root)
+}
+
+// normalizeRoot makes every root look like "/", "/posts/" and so on.
+func normalizeRoot(root string) string {
+	clean := path.Clean("/" + root)
+	if clean == "/" {
+		return clean
+	}
+	return clean + "/"
+}
+
+// sourcePaths lists the paths a source writes to. disabled sources and
+// those without a known provider, like the ones just added, write nothing.
+func sourcePaths(source Source) []string {
+	provider, ok := providers[source.Provider]
+	if !ok || source.disabled() {
+		return nil
+	}
+	return provider.Paths(normalizeRoot(source.Root), source.Data)
+}
+
+// pathConflicts returns every pair of overlapping paths between sources,
+// each pair only once and in the order the sources are given.
+func pathConflicts(sources []Source) (conflicts []PathConflict) {
+	type claim struct {
+		path   string
+		source Source
+	}
+	claims := []claim{{errorPagePath, Source{}}}
+
+	for _, source := range sources {
+		var mine []claim
+		for _, p := range sourcePaths(source) {
+			for _, other := range claims {
+				if pathsOverlap(p, other.path) {
+					conflicts = append(conflicts, PathConflict{
+						Path:        p,
+						Source:      source,
+						OtherPath:   other.path,
+						OtherSource: other.source,
+					})
+				}
+			}
+			mine = append(mine, claim{p, source})
+		}
+		claims = append(claims, mine...)
+	}
+	return
+}
+
+func pathsOverlap(a, b string) bool {
+	if strings.HasSuffix(a, "*") && strings.HasPrefix(b, strings.TrimSuffix(a, "*")) {
+		return true
+	}
+	if strings.HasSuffix(b, "*") && strings.HasPrefix(a, strings.TrimSuffix(b, "*")) {
+		return true
+	}
+	return a == b
+}
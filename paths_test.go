@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+func TestPathsOverlap(t *testing.T) {
+	for _, test := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"/", "/", true},
+		{"/", "/about/", false},
+		{"/about/", "/about/me/", false},
+		{"/p/*", "/p/2/", true},
+		{"/p/2/", "/p/*", true},
+		{"/p/*", "/posts/", false},
+		{"/posts/p/*", "/posts/*", true},
+		{"/a/*", "/b/*", false},
+	} {
+		if got := pathsOverlap(test.a, test.b); got != test.overlap {
+			t.Errorf("pathsOverlap(%q, %q) = %v", test.a, test.b, got)
+		}
+	}
+}
+
+func TestNormalizeRoot(t *testing.T) {
+	for root, expected := range map[string]string{
+		"":          "/",
+		"/":         "/",
+		"about":     "/about/",
+		"/about/":   "/about/",
+		"//a/./b/":  "/a/b/",
+		"/a/../../": "/",
+	} {
+		if got := normalizeRoot(root); got != expected {
+			t.Errorf("normalizeRoot(%q) = %q, not %q", root, got, expected)
+		}
+	}
+}
+
+func TestPathConflicts(t *testing.T) {
+	disabled := false
+	page := func(id int, root string) Source {
+		return Source{Id: id, Root: root, Provider: "url:html",
+			Data: types.JSONText(`{"url": "https://example.com/"}`)}
+	}
+	feed := func(id int, root string) Source {
+		return Source{Id: id, Root: root, Provider: "feed:rss",
+			Data: types.JSONText(`{"url": "https://example.com/feed"}`)}
+	}
+	off := page(9, "/")
+	off.Enabled = &disabled
+
+	for _, test := range []struct {
+		name      string
+		sources   []Source
+		conflicts [][2]int // ids of the sources, 0 for the error page
+	}{
+		{"separate roots", []Source{page(1, "/"), page(2, "/about")}, nil},
+		{"same root", []Source{page(1, "/"), page(2, "/")}, [][2]int{{2, 1}}},
+		{"same root written differently", []Source{page(1, "about"), page(2, "/about/")}, [][2]int{{2, 1}}},
+		{"error page", []Source{page(1, "/error")}, [][2]int{{1, 0}}},
+		{"pagination", []Source{feed(1, "/"), page(2, "/p/2")}, [][2]int{{2, 1}}},
+		{"pagination elsewhere", []Source{feed(1, "/blog"), page(2, "/p/2")}, nil},
+		{"disabled", []Source{page(1, "/"), off}, nil},
+		{"unknown provider", []Source{page(1, "/"), {Id: 2, Root: "/", Provider: ""}}, nil},
+		{"three on the same root", []Source{page(1, "/"), page(2, "/"), page(3, "/")},
+			[][2]int{{2, 1}, {3, 1}, {3, 2}}},
+	} {
+		conflicts := pathConflicts(test.sources)
+		if len(conflicts) != len(test.conflicts) {
+			t.Errorf("%s: %d conflicts, not %d: %v", test.name, len(conflicts),
+				len(test.conflicts), conflicts)
+			continue
+		}
+		for i, conflict := range conflicts {
+			expected := test.conflicts[i]
+			if conflict.Source.Id != expected[0] || conflict.OtherSource.Id != expected[1] {
+				t.Errorf("%s: conflict %d is %s", test.name, i, conflict)
+			}
+		}
+	}
+}
@@ -2,7 +2,28 @@ CREATE TABLE sites (
   id serial PRIMARY KEY,
   owner text,
   domain text UNIQUE,
-  data jsonb NOT NULL DEFAULT '{}'
+  data jsonb NOT NULL DEFAULT '{}',
+  generator text NOT NULL DEFAULT 'sitio', -- sitio or native
+  publish_every int, -- minutes between automatic publishes, NULL for never
+  next_publish_at timestamptz,
+  hook_token text, -- secret part of the webhook url, NULL until requested
+  live_build int, -- the site_builds row whose version is being served
+  domain_verified boolean NOT NULL DEFAULT false, -- see domains.go
+  owner_proven boolean NOT NULL DEFAULT false, -- a TXT record was seen, see domains.go
+  verify_token text -- expected in the TXT record, NULL until requested
+);
+
+CREATE TABLE site_redirects (
+  domain text PRIMARY KEY, -- a former domain of the site, now redirecting
+  site int REFERENCES sites (id)
+);
+
+CREATE TABLE domain_claims (
+  domain text,
+  owner text,
+  token text NOT NULL, -- expected in the TXT record at _sitios.{domain}
+  created_at timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (domain, owner)
 );
 
 CREATE TABLE sources (
@@ -10,7 +31,55 @@ CREATE TABLE sources (
   site int REFERENCES sites (id),
   provider text NOT NULL, -- trello:card, trello:board, trello:list,
                           -- url:html, url:markdown
-  root text NOT NULL -- where in the site this will appear: '/', '/posts' etc.
-  data jsonb NOT NULL DEFAULT '{}' -- anything the providers may need
+  root text NOT NULL, -- where in the site this will appear: '/', '/posts' etc.
+  data jsonb NOT NULL DEFAULT '{}', -- anything the providers may need
+  position int NOT NULL DEFAULT 0, -- sources are generated in this order
+  enabled boolean NOT NULL DEFAULT true, -- disabled sources are not published
+  on_error text NOT NULL DEFAULT 'fail' -- fail, skip or placeholder
+);
+
+
+CREATE TABLE uploads (
+  id serial PRIMARY KEY,
+  site int REFERENCES sites (id),
+  source int REFERENCES sources (id), -- a files:upload source
+  name text NOT NULL, -- path under the root of the source
+  size bigint NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  UNIQUE (source, name)
 );
 
+CREATE TABLE publish_jobs (
+  id serial PRIMARY KEY,
+  site int REFERENCES sites (id),
+  state text NOT NULL DEFAULT 'queued', -- queued, running, succeeded, failed
+  origin text NOT NULL DEFAULT 'manual', -- manual, schedule, webhook, reconcile
+  error text NOT NULL DEFAULT '',
+  created_at timestamptz NOT NULL DEFAULT now(),
+  started_at timestamptz,
+  finished_at timestamptz
+);
+
+-- a site never has more than one job waiting
+CREATE UNIQUE INDEX ON publish_jobs (site) WHERE state = 'queued';
+
+CREATE TABLE site_builds (
+  id serial PRIMARY KEY,
+  site int REFERENCES sites (id),
+  status text NOT NULL DEFAULT 'running', -- running, succeeded, failed
+  log text NOT NULL DEFAULT '', -- everything the build printed
+  files int NOT NULL DEFAULT 0, -- uploaded, not counting unchanged ones
+  bytes bigint NOT NULL DEFAULT 0,
+  sources jsonb NOT NULL DEFAULT '[]', -- how each source fared
+  started_at timestamptz NOT NULL DEFAULT now(),
+  finished_at timestamptz
+);
+
+CREATE TABLE previews (
+  site int PRIMARY KEY REFERENCES sites (id),
+  domain text NOT NULL, -- preview-{random}.{MAIN_HOSTNAME}
+  state text NOT NULL DEFAULT 'queued', -- queued, building, ready, failed
+  error text NOT NULL DEFAULT '',
+  request jsonb NOT NULL DEFAULT '{}', -- the site as given to startPreview
+  expires_at timestamptz NOT NULL
+);
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// previews are generated from site data and sources that may not even be
+// saved yet, and are served from a throwaway domain for a while without
+// touching the live site. each site has at most one preview domain, reused
+// by new previews until it expires.
+
+var previewTTL = envDuration("PREVIEW_TTL", 24*time.Hour)
+
+type Preview struct {
+	Site      int       `db:"site" json:"site"`
+	Domain    string    `db:"domain" json:"domain"`
+	State     string    `db:"state" json:"state"`
+	Error     string    `db:"error" json:"error,omitempty"`
+	ExpiresAt time.Time `db:"expires_at" json:"expires_at"`
+}
+
+// startPreview queues a preview of the site, which the publish workers
+// build when they're free. data, sources and the generator not given in
+// site are taken from what is saved.
+func startPreview(pg *sqlx.DB, user string, site Site) (preview Preview, err error) {
+	if mainHostname == "" {
+		return preview, errors.New("previews need a MAIN_HOSTNAME to live under.")
+	}
+
+	saved, err := fetchSite(pg, user, site.Id)
+	if err != nil {
+		return
+	}
+	if isEmptyJSON(site.Data) {
+		site.Data = saved.Data
+	}
+	if site.Generator == "" {
+		site.Generator = saved.Generator
+	}
+	if isEmptyJSON(site.Sources) {
+		site.Sources = saved.Sources
+	} else {
+		// unsaved sources haven't gone through updateSource
+		var sources []Source
+		if site.Sources.Unmarshal(&sources) != nil {
+			err = FieldErrors{{"sources", "must be a list of sources"}}
+			return
+		}
+		for _, source := range sources {
+			if errs := validateSource(source); len(errs) > 0 {
+				err = errs
+				return
+			}
+		}
+	}
+
+	request, err := json.Marshal(previewRequest{site.Data, site.Sources, site.Generator})
+	if err != nil {
+		return
+	}
+
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+
+	err = pg.Get(&preview, `
+INSERT INTO previews (site, domain, expires_at, request)
+VALUES ($1, $2, now() + make_interval(secs => $3), $4)
+ON CONFLICT (site) DO UPDATE
+SET state = 'queued', error = '', expires_at = excluded.expires_at,
+  request = excluded.request
+RETURNING site, domain, state, error, expires_at
+    `, saved.Id, "preview-"+hex.EncodeToString(b)+"."+mainHostname,
+		previewTTL.Seconds(), types.JSONText(request))
+	if err != nil {
+		return
+	}
+
+	wakePublishWorkers()
+	return
+}
+
+// previewRequest is what startPreview was given, saved for the worker.
+type previewRequest struct {
+	Data      types.JSONText `json:"data"`
+	Sources   types.JSONText `json:"sources"`
+	Generator string         `json:"generator"`
+}
+
+// claimPreview takes a queued preview, the site it returns is ready to be
+// given to buildPreview.
+func claimPreview(pg *sqlx.DB) (site Site, owner string, err error) {
+	var request types.JSONText
+	row := pg.QueryRowx(`
+UPDATE previews SET state = 'building'
+WHERE site = (
+  SELECT site FROM previews
+  WHERE state = 'queued'
+  ORDER BY expires_at
+  LIMIT 1
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING site, domain, request,
+  (SELECT owner FROM sites WHERE sites.id = previews.site)
+    `)
+	err = row.Scan(&site.Id, &site.Domain, &request, &owner)
+	if err != nil {
+		return
+	}
+
+	var req previewRequest
+	err = request.Unmarshal(&req)
+	site.Data, site.Sources, site.Generator = req.Data, req.Sources, req.Generator
+	return
+}
+
+// runPreview builds a preview claimed by a publish worker and saves how it
+// went.
+func runPreview(pg *sqlx.DB, site Site, owner string) {
+	out := &logproxy{conn: userConnection(owner)}
+	err := buildPreview(site, out)
+	if err != nil {
+		out.Print("Error: " + err.Error())
+		log.Warn().
+			Err(err).
+			Int("site", site.Id).
+			Msg("preview failed")
+	}
+
+	err = finishPreview(pg, site.Id, err)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Int("site", site.Id).
+			Msg("couldn't save preview state")
+	}
+}
+
+func buildPreview(site Site, out *logproxy) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while building preview: %v", r)
+		}
+	}()
+
+	dirname, err := ioutil.TempDir("", "sitios-preview")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dirname)
+
+	_, err = generateSite(site, dirname, out)
+	if err != nil {
+		return err
+	}
+
+	out.Print("Now publishing preview...")
+	version := strconv.FormatInt(time.Now().Unix(), 10)
+	_, err = deploy(site.Domain, version, filepath.Join(dirname, "_site"), out, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	out.Print("Preview available at https://" + site.Domain + "/")
+	return nil
+}
+
+// requeuePreviews puts back in the queue the previews that were being
+// built when the server last stopped.
+func requeuePreviews(pg *sqlx.DB) error {
+	_, err := pg.Exec(`
+UPDATE previews SET state = 'queued' WHERE state = 'building'
+    `)
+	return err
+}
+
+func finishPreview(pg *sqlx.DB, siteId int, previewErr error) error {
+	state := "ready"
+	message := ""
+	if previewErr != nil {
+		state = "failed"
+		message = previewErr.Error()
+	}
+
+	_, err := pg.Exec(`
+UPDATE previews SET state = $2, error = $3
+WHERE site = $1
+    `, siteId, state, message)
+	return err
+}
+
+func fetchPreview(pg *sqlx.DB, user string, siteId int) (preview Preview, err error) {
+	err = pg.Get(&preview, `
+SELECT previews.site, previews.domain, previews.state, previews.error,
+  previews.expires_at
+FROM previews
+INNER JOIN sites ON sites.id = previews.site
+WHERE sites.owner = $1 AND sites.id = $2
+    `, user, siteId)
+	return
+}
+
+// removePreview deletes the preview of a site, if it has one.
+func removePreview(pg *sqlx.DB, siteId int) error {
+	var domains []string
+	err := pg.Select(&domains, `
+DELETE FROM previews WHERE site = $1
+RETURNING domain
+    `, siteId)
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range domains {
+		err = removePreviewDomain(domain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removePreviewDomain(domain string) error {
+	err := storage.RemoveTarget(domain)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(domain, mainHostname) {
+		return removeSubdomainDNS(domain)
+	}
+	return nil
+}
+
+func startPreviewJanitor(pg *sqlx.DB) {
+	go func() {
+		for {
+			err := removeExpiredPreviews(pg)
+			if err != nil {
+				log.Error().
+					Err(err).
+					Msg("failed to remove expired previews")
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+}
+
+// removeExpiredPreviews leaves alone the previews still waiting or being
+// built, as their files would be written back after being removed. they
+// expire once they're done.
+func removeExpiredPreviews(pg *sqlx.DB) error {
+	var domains []string
+	err := pg.Select(&domains, `
+DELETE FROM previews
+WHERE expires_at < now() AND state NOT IN ('queued', 'building')
+RETURNING domain
+    `)
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range domains {
+		err = removePreviewDomain(domain)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("domain", domain).
+				Msg("couldn't remove expired preview")
+		}
+	}
+	return nil
+}
+
+func isEmptyJSON(j []byte) bool {
+	s := strings.TrimSpace(string(j))
+	return s == "" || s == "null"
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/a8m/mark"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// Provider knows what a source of some kind must have in its data and how
+// to turn it into pages.
+type Provider interface {
+	// Validate checks the data of a source before it is saved.
+	Validate(data types.JSONText) FieldErrors
+
+	// Render fetches the source contents and returns the pages and files
+	// it produces under its root.
+	Render(source Source) ([]Page, []File, error)
+
+	// Paths lists the paths Render, or the sitio plugin, will write to
+	// without fetching anything, see paths.go.
+	Paths(root string, data types.JSONText) []string
+}
+
+// providers has every provider a source can use. the ones only available
+// as sitio plugins (see sitioPlugins) can be validated here but only the
+// others can be rendered by the native generator. those without a sitio
+// plugin, like feed:rss, are rendered here for every site.
+var providers = map[string]Provider{
+	"url:html":     urlProvider{},
+	"url:markdown": urlProvider{markdown: true},
+	"trello:list": sitioProvider{
+		fields: trelloFields(
+			field{"id", "string", true},
+		),
+		paginated: true,
+	},
+	"trello:board": sitioProvider{
+		fields: trelloFields(
+			field{"ref", "string", true},
+		),
+		paginated: true,
+	},
+	"evernote:note": sitioProvider{
+		fields: []field{
+			{"url", "url", true},
+		},
+	},
+	"dropbox:file": sitioProvider{
+		fields: []field{
+			{"url", "url", true},
+		},
+	},
+	"dropbox:folder": sitioProvider{
+		fields: []field{
+			{"url", "url", true},
+		},
+	},
+	"medium:profile": sitioProvider{
+		fields: []field{
+			{"profileURL", "url", true},
+			{"postsPerPage", "int", false},
+			{"excerpts", "bool", false},
+		},
+		paginated: true,
+	},
+	"feed:rss":       feedProvider{},
+	"git:repository": gitProvider{},
+	"files:upload":   uploadProvider{},
+}
+
+func trelloFields(extra ...field) []field {
+	return append([]field{
+		{"apiKey", "string", true},
+		{"apiToken", "string", true},
+		{"postsPerPage", "int", false},
+		{"excerpts", "bool", false},
+	}, extra...)
+}
+
+// validateSource returns nil if the source is good to be saved.
+func validateSource(source Source) FieldErrors {
+	provider, ok := providers[source.Provider]
+	if !ok {
+		return FieldErrors{{"provider", "is unknown: '" + source.Provider + "'"}}
+	}
+
+	errs := provider.Validate(source.Data)
+	switch source.OnError {
+	case "", onErrorFail, onErrorSkip, onErrorPlaceholder:
+	default:
+		errs = append(errs, FieldError{"on_error", "must be fail, skip or placeholder"})
+	}
+	return errs
+}
+
+// sitioProvider is a provider rendered by a sitio plugin, of which we only
+// know the fields it expects and if it splits its index in pages.
+type sitioProvider struct {
+	fields    []field
+	paginated bool
+}
+
+func (p sitioProvider) Validate(data types.JSONText) FieldErrors {
+	return validateFields(p.fields, data)
+}
+
+// Paths doesn't include the pages of each entry, as their names are only
+// known after fetching them.
+func (p sitioProvider) Paths(root string, data types.JSONText) []string {
+	if p.paginated {
+		// the index continues on root/p/2/, root/p/3/ and so on
+		return []string{root, root + "p/*"}
+	}
+	return []string{root}
+}
+
+func (p sitioProvider) Render(source Source) ([]Page, []File, error) {
+	return nil, nil, errors.New("only available with the sitio generator")
+}
+
+// urlProvider renders a single page from an HTML or Markdown document
+// fetched from data.url.
+type urlProvider struct {
+	markdown bool
+}
+
+type urlData struct {
+	URL      string `json:"url"`
+	FullPage bool   `json:"full-page"`
+}
+
+var urlFields = []field{
+	{"url", "url", true},
+	{"full-page", "bool", false},
+}
+
+func (p urlProvider) Validate(data types.JSONText) FieldErrors {
+	return validateFields(urlFields, data)
+}
+
+func (p urlProvider) Paths(root string, data types.JSONText) []string {
+	return []string{root}
+}
+
+func (p urlProvider) Render(source Source) ([]Page, []File, error) {
+	var d urlData
+	err := source.Data.Unmarshal(&d)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := fetchText(d.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page := Page{Path: source.Root}
+	if p.markdown {
+		meta, markdown := frontMatter(body)
+		page.Title = meta["title"]
+		page.Content = template.HTML(mark.Render(markdown))
+	} else if d.FullPage {
+		page.Content = template.HTML(htmlBody(body))
+	} else {
+		page.Content = template.HTML(body)
+	}
+	return []Page{page}, nil, nil
+}
+
+func validateURL(raw string) error {
+	if raw == "" {
+		return errors.New("url is missing")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid url: " + raw)
+	}
+	return nil
+}
+
+const fetchTimeout = 1 * time.Minute
+
+// fetchClient is used for everything sources fetch, so a server that never
+// answers can't hold a publish worker forever.
+var fetchClient = &http.Client{Timeout: fetchTimeout}
+
+func fetchText(url string) (string, error) {
+	resp, err := fetchClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", errors.New(url + " returned " + resp.Status)
+	}
+	return string(body), nil
+}
+
+// frontMatter splits a document into its YAML front-matter, of which only
+// flat "key: value" lines are understood, and the rest.
+func frontMatter(doc string) (meta map[string]string, rest string) {
+	meta = make(map[string]string)
+	if !strings.HasPrefix(doc, "---\n") {
+		return meta, doc
+	}
+
+	end := strings.Index(doc[4:], "\n---")
+	if end == -1 {
+		return meta, doc
+	}
+	header := doc[4 : 4+end]
+	rest = strings.TrimPrefix(doc[4+end+4:], "\n")
+
+	scanner := bufio.NewScanner(strings.NewReader(header))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		meta[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+	}
+	return meta, rest
+}
+
+// htmlBody returns what is inside the <body> of a full HTML page.
+func htmlBody(page string) string {
+	lower := strings.ToLower(page)
+	start := strings.Index(lower, "<body")
+	if start == -1 {
+		return page
+	}
+	open := strings.Index(lower[start:], ">")
+	if open == -1 {
+		return page
+	}
+	start += open + 1
+	end := strings.LastIndex(lower, "</body>")
+	if end < start {
+		end = len(page)
+	}
+	return page[start:end]
+}
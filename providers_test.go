@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+func fixtureServer(files map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestURLProviderRender(t *testing.T) {
+	server := fixtureServer(map[string]string{
+		"/page.html": "<html><head><title>x</title></head><body><p>hello</p></body></html>",
+		"/post.md":   "---\ntitle: A post\n---\nhello",
+	})
+	defer server.Close()
+
+	for _, test := range []struct {
+		provider string
+		data     string
+		title    string
+		content  string
+		absent   string
+	}{
+		{"url:html", `{"url": "` + server.URL + `/page.html"}`, "", "<title>", ""},
+		{"url:html", `{"url": "` + server.URL + `/page.html", "full-page": true}`, "", "<p>hello</p>", "<title>"},
+		{"url:markdown", `{"url": "` + server.URL + `/post.md"}`, "A post", "hello", "---"},
+	} {
+		pages, files, err := providers[test.provider].Render(Source{
+			Root:     "/about",
+			Provider: test.provider,
+			Data:     types.JSONText(test.data),
+		})
+		if err != nil {
+			t.Errorf("%s %s: %s", test.provider, test.data, err)
+			continue
+		}
+		if len(pages) != 1 || len(files) != 0 {
+			t.Errorf("%s %s: %d pages and %d files", test.provider, test.data, len(pages), len(files))
+			continue
+		}
+		page := pages[0]
+		if page.Path != "/about" || page.Title != test.title ||
+			!strings.Contains(string(page.Content), test.content) ||
+			(test.absent != "" && strings.Contains(string(page.Content), test.absent)) {
+			t.Errorf("%s %s: got %+v", test.provider, test.data, page)
+		}
+	}
+}
+
+func TestURLProviderMissing(t *testing.T) {
+	server := fixtureServer(nil)
+	defer server.Close()
+
+	_, _, err := providers["url:html"].Render(Source{
+		Root:     "/",
+		Provider: "url:html",
+		Data:     types.JSONText(`{"url": "` + server.URL + `/nothing"}`),
+	})
+	if err == nil {
+		t.Error("rendered a page that returned 404")
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	meta, rest := frontMatter("---\ntitle: Hello\nslug: hi\n---\nbody")
+	if meta["title"] != "Hello" || meta["slug"] != "hi" || strings.TrimSpace(rest) != "body" {
+		t.Errorf("got %v and %q", meta, rest)
+	}
+
+	meta, rest = frontMatter("no front-matter")
+	if len(meta) != 0 || rest != "no front-matter" {
+		t.Errorf("got %v and %q", meta, rest)
+	}
+}
+
+func TestFetchTextTimeout(t *testing.T) {
+	defer func(c *http.Client) { fetchClient = c }(fetchClient)
+	fetchClient = &http.Client{Timeout: 50 * time.Millisecond}
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	if _, err := fetchText(server.URL); err == nil {
+		t.Error("fetched from a server that never answers")
+	}
+}
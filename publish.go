@@ -2,39 +2,151 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
 
 	"github.com/a8m/mark"
-	"github.com/gorilla/websocket"
 )
 
 type GenerateContext struct {
-	Globals map[string]interface{}
-	Sources []Source
+	Globals    map[string]interface{}
+	Sources    []Source
+	Plugins    map[string]string
+	TargetDir  string
+	StatusFile string // where generate.js writes a SourceStatus for each source
 }
 
-func publish(site Site, conn *websocket.Conn) error {
-	dirname, err := ioutil.TempDir("", "sitios")
+// sitioPlugins are the sitio plugins that render each provider in sites
+// generated by sitio. sources of other providers are rendered by their Go
+// providers in those sites too, after sitio is done.
+var sitioPlugins = map[string]string{
+	"url:html":       "sitio-url",
+	"url:markdown":   "sitio-url",
+	"trello:list":    "sitio-trello/list",
+	"trello:board":   "sitio-trello/board",
+	"evernote:note":  "sitio-evernote/note",
+	"dropbox:file":   "sitio-dropbox/file",
+	"dropbox:folder": "sitio-dropbox/folder",
+	"medium:profile": "sitio-medium/list",
+}
+
+// publish generates and uploads a site, recording the run and everything
+// it printed as a build.
+func publish(site Site, conn *wsconn) error {
+	out := &logproxy{conn: conn}
+
+	// the build id is also the name of the version we'll store
+	buildId, err := startBuild(pg, site.Id)
 	if err != nil {
+		out.Print("Error: couldn't start build: " + err.Error())
 		return err
 	}
-	defer os.RemoveAll(dirname)
 
-	var sources []Source
-	err = site.Sources.Unmarshal(&sources)
+	result, statuses, err := buildSite(site, buildId, out)
+	if err != nil {
+		out.Print("Error: " + err.Error())
+	}
+
+	ferr := finishBuild(pg, buildId, err, out.String(), result, statuses)
+	if ferr != nil {
+		log.Warn().
+			Err(ferr).
+			Int("build", buildId).
+			Msg("couldn't record build result")
+	}
+
+	return err
+}
+
+// rollback serves again the version stored by a previous build.
+func rollback(site Site, buildId int) error {
+	_, err := fetchSucceededBuild(pg, site.Id, buildId)
 	if err != nil {
 		return err
 	}
 
+	unlock := lockSiteActivation(site.Domain)
+	defer unlock()
+
+	err = checkSiteDomain(pg, site.Id, site.Domain)
+	if err != nil {
+		return err
+	}
+	err = storage.Activate(site.Domain, strconv.Itoa(buildId))
+	if err != nil {
+		return err
+	}
+	return setLiveBuild(pg, site.Id, buildId)
+}
+
+func buildSite(site Site, buildId int, out *logproxy) (result UploadResult, statuses []SourceStatus, err error) {
+	if isCustomDomain(site.Domain) && !site.DomainVerified {
+		err = errors.New("the domain " + site.Domain + " must be verified before publishing")
+		return
+	}
+
+	dirname, err := ioutil.TempDir("", "sitios")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dirname)
+
+	statuses, err = generateSite(site, dirname, out)
+	if err != nil {
+		return
+	}
+
+	// send files to storage
+	out.Print("Now publishing...")
+	result, err = deploy(site.Domain, strconv.Itoa(buildId),
+		filepath.Join(dirname, "_site"), out,
+		func() error {
+			return checkSiteDomain(pg, site.Id, site.Domain)
+		},
+		func() error {
+			return setLiveBuild(pg, site.Id, buildId)
+		})
+	return
+}
+
+// generateSite renders the site into dirname/_site and tells how each
+// source fared.
+func generateSite(site Site, dirname string, out *logproxy) (statuses []SourceStatus, err error) {
+	// fetchSite gives us the sources in the order they must be generated
+	var all []Source
+	err = site.Sources.Unmarshal(&all)
+	if err != nil {
+		return
+	}
+	sources := make([]Source, 0, len(all))
+	for _, source := range all {
+		if source.disabled() {
+			out.Print("Skipping disabled " + source.Provider + " on " + source.Root + ".")
+			continue
+		}
+		source.Site = site.Id
+		sources = append(sources, source)
+	}
+	if conflicts := pathConflicts(sources); len(conflicts) > 0 {
+		problems := make([]string, len(conflicts))
+		for i, conflict := range conflicts {
+			problems[i] = conflict.String()
+		}
+		err = errors.New("sources overlap: " + strings.Join(problems, "; "))
+		return
+	}
+
 	var globals map[string]interface{}
 	err = site.Data.Unmarshal(&globals)
 	if err != nil {
-		return err
+		return
 	}
 	globals["rootURL"] = "https://" + site.Domain
 	if desc, ok := globals["description"].(string); ok {
@@ -53,11 +165,53 @@ func publish(site Site, conn *websocket.Conn) error {
 		globals["footer"] = ""
 	}
 
+	target := filepath.Join(dirname, "_site")
+	if site.Generator == "native" {
+		log.Debug().Str("domain", site.Domain).Msg("generating site natively.")
+		statuses, err = generateNative(globals, sources, target, out)
+	} else {
+		statuses, err = generateSitio(globals, sources, dirname, out)
+	}
+	if err != nil {
+		return
+	}
+
+	live, err := fetchLiveOutput(site.Id)
+	if err != nil {
+		return
+	}
+	err = applyFailurePolicies(live, globals, sources, statuses, target, out)
+	if err != nil {
+		return
+	}
+	log.Debug().Msg("site generated successfully.")
+	out.Print("Site generated successfully.")
+	return
+}
+
+// generateSitio runs the sitio plugins for each source through
+// skeleton/generate.js.
+func generateSitio(globals map[string]interface{}, sources []Source, dirname string, out *logproxy) (statuses []SourceStatus, err error) {
+	var plugged, native []Source
+	for _, source := range sources {
+		if _, ok := sitioPlugins[source.Provider]; ok {
+			plugged = append(plugged, source)
+		} else {
+			native = append(native, source)
+		}
+	}
+	if plugged == nil {
+		plugged = []Source{}
+	}
+
 	// generate the generate.js file to be passed to sitio
-	log.Debug().Str("domain", site.Domain).Msg("generating generate.js")
+	log.Debug().Msg("generating generate.js")
 	ctx := GenerateContext{
-		Globals: globals,
-		Sources: sources,
+		Globals:    globals,
+		Sources:    plugged,
+		Plugins:    sitioPlugins,
+		TargetDir:  filepath.Join(dirname, "_site"),
+		StatusFile: filepath.Join(dirname, "status.json"),
 	}
 
 	t := template.New("generate.js")
@@ -69,16 +223,17 @@ func publish(site Site, conn *websocket.Conn) error {
 	})
 	t, err = t.ParseFiles("skeleton/generate.js")
 	if err != nil {
-		return err
+		return
 	}
 
 	generateFile, err := os.Create(filepath.Join(dirname, "generate.js"))
 	if err != nil {
-		return err
+		return
 	}
 	err = t.Execute(generateFile, ctx)
+	generateFile.Close()
 	if err != nil {
-		return err
+		return
 	}
 
 	// run the generate.js file
@@ -87,62 +242,106 @@ func publish(site Site, conn *websocket.Conn) error {
 		filepath.Join(dirname, "generate.js"),
 		"--body=body.js",
 		"--helmet=head.js",
-		"--target-dir="+filepath.Join(dirname, "_site"),
+		"--target-dir="+ctx.TargetDir,
 	)
 	cmd.Dir = "skeleton"
-	cmd.Stdout = logproxy{conn}
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = out
+	cmd.Stderr = io.MultiWriter(os.Stderr, out)
 	err = cmd.Run()
 	if err != nil {
-		return err
+		return
 	}
-	log.Debug().Msg("site generated successfully.")
-	if conn != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte("Site generated successfully."))
+
+	status, err := ioutil.ReadFile(ctx.StatusFile)
+	if err != nil {
+		err = errors.New("generate.js didn't report how the sources went: " + err.Error())
+		return
+	}
+	var pluggedStatuses []SourceStatus
+	err = json.Unmarshal(status, &pluggedStatuses)
+	if err != nil {
+		return
+	}
+
+	nativeStatuses, err := renderSources(newLayoutGlobals(globals), native, sources, ctx.TargetDir, out)
+	if err != nil {
+		return
 	}
 
-	// send files to s3
-	if conn != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte("Now publishing..."))
+	// statuses in the same order as sources
+	byId := make(map[int]SourceStatus)
+	for _, s := range append(pluggedStatuses, nativeStatuses...) {
+		byId[s.Id] = s
 	}
-	log.Debug().Msg("uploading to s3...")
-	err = ensureBucket(site.Domain)
+	for _, source := range sources {
+		if s, ok := byId[source.Id]; ok {
+			statuses = append(statuses, s)
+		}
+	}
+	return
+}
+
+// deploy uploads the generated files in dirname as a new version of domain
+// and starts serving it. check, if given, is called before anything is
+// done, once no one else can touch domain, and activated right after the
+// new version is served.
+func deploy(domain, version, dirname string, out *logproxy, check, activated func() error) (result UploadResult, err error) {
+	unlock := lockSiteActivation(domain)
+	defer unlock()
+	if check != nil {
+		err = check()
+		if err != nil {
+			return
+		}
+	}
+
+	log.Debug().Msg("uploading to storage...")
+	err = storage.EnsureTarget(domain)
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte("Error creating S3 bucket: "+err.Error()))
-		return err
+		err = errors.New("preparing site storage: " + err.Error())
+		return
 	}
 
-	err = uploadFilesToBucket(site.Domain, filepath.Join(dirname, "_site"))
+	result, err = storage.UploadTree(domain, version, dirname)
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte("Error publishing to S3: "+err.Error()))
-		return err
+		storage.RemoveVersion(domain, version)
+		err = errors.New("uploading files: " + err.Error())
+		return
 	}
+	out.Print(result.String())
 
-	if strings.HasSuffix(site.Domain, mainHostname) {
+	// only now that everything is uploaded we start serving the new version
+	err = storage.Activate(domain, version)
+	if err == nil && activated != nil {
+		err = activated()
+	}
+	if err == nil {
+		err = pruneVersions(domain, version)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("domain", domain).
+				Msg("couldn't remove old versions")
+			err = nil
+		}
+	}
+	if err != nil {
+		err = errors.New("activating new version: " + err.Error())
+		return
+	}
+
+	if strings.HasSuffix(domain, mainHostname) {
 		log.Debug().Msg("setting dns record...")
 		// make https work by explicit adding a CNAME to cloudflare
 		err = setupSubdomainDNS(
-			strings.TrimSuffix(site.Domain, "."+mainHostname),
+			strings.TrimSuffix(domain, "."+mainHostname),
 		)
 		if err != nil {
-			conn.WriteMessage(websocket.TextMessage, []byte("Error setting DNS records: "+err.Error()))
-			return err
+			err = errors.New("setting DNS records: " + err.Error())
+			return
 		}
 	}
 
-	if conn != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte("Published successfully."))
-	}
-	return nil
-}
-
-type logproxy struct {
-	conn *websocket.Conn
-}
-
-func (l logproxy) Write(p []byte) (n int, err error) {
-	if l.conn != nil {
-		l.conn.WriteMessage(websocket.TextMessage, p)
-	}
-	return len(p), nil
+	out.Print("Published successfully.")
+	return
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// the reconciler compares the sites we have with the DNS records under
+// mainHostname and the storage targets, since a failed publish or
+// delete-site can leave them out of sync. it runs every
+// RECONCILE_INTERVAL and only reports the drift unless RECONCILE_FIX is
+// set, in which case it also fixes it.
+
+var reconcileInterval = envDuration("RECONCILE_INTERVAL", 6*time.Hour)
+
+var reconcileFix = os.Getenv("RECONCILE_FIX") == "true"
+
+// Drift is what is different from what it should be.
+type Drift struct {
+	MissingRecords []DNSRecord // for published sites and previews
+	WrongRecords   []DNSRecord // with the contents they should have
+	OrphanRecords  []DNSRecord // pointing to the storage, for domains no site or preview has
+	MissingTargets []int       // sites that were published but have no target
+	OrphanTargets  []string    // for domains no site or preview has
+}
+
+func (d Drift) Empty() bool {
+	return len(d.MissingRecords) == 0 && len(d.WrongRecords) == 0 &&
+		len(d.OrphanRecords) == 0 && len(d.MissingTargets) == 0 &&
+		len(d.OrphanTargets) == 0
+}
+
+type knownDomain struct {
+	Domain    string `db:"domain"`
+	Site      int    `db:"site"`
+	Published bool   `db:"published"`
+	Redirect  bool   `db:"redirect"` // has a record but no files
+}
+
+// findDrift looks at everything and says what is wrong.
+func findDrift(pg *sqlx.DB) (drift Drift, err error) {
+	var known []knownDomain
+	err = pg.Select(&known, `
+SELECT domain, id AS site, live_build IS NOT NULL AS published, false AS redirect
+FROM sites
+UNION ALL
+SELECT domain, site, state = 'ready' AS published, false AS redirect
+FROM previews
+UNION ALL
+SELECT domain, site, true AS published, true AS redirect
+FROM site_redirects
+    `)
+	if err != nil {
+		return
+	}
+	return compareDrift(known)
+}
+
+// compareDrift says what is wrong in the dns records and the storage
+// targets given the domains we know about.
+func compareDrift(known []knownDomain) (drift Drift, err error) {
+	domains := make(map[string]knownDomain)
+	for _, k := range known {
+		domains[strings.ToLower(k.Domain)] = k
+	}
+
+	// dns records
+	records, err := dns.ListRecords()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, record := range records {
+		name := strings.ToLower(record.Name)
+		if record.Type != "CNAME" || !strings.HasSuffix(name, "."+mainHostname) ||
+			name == aliasHostname() || name == serviceHostname() {
+			continue
+		}
+
+		k, ok := domains[name]
+		switch {
+		case !ok:
+			// the zone may have other records, like www or the ones for
+			// email, so only those pointing to the storage are ours.
+			if strings.EqualFold(record.Content, storage.CNAMETarget()) {
+				drift.OrphanRecords = append(drift.OrphanRecords, record)
+			}
+		case k.Published && record.Content != storage.CNAMETarget():
+			record.Content = storage.CNAMETarget()
+			drift.WrongRecords = append(drift.WrongRecords, record)
+		}
+		seen[name] = true
+	}
+	for name, k := range domains {
+		if k.Published && !seen[name] && !isCustomDomain(name) {
+			drift.MissingRecords = append(drift.MissingRecords, DNSRecord{
+				Type:    "CNAME",
+				Name:    name,
+				Content: storage.CNAMETarget(),
+				Proxied: true,
+			})
+		}
+	}
+
+	// storage targets
+	targets, err := storage.Targets()
+	if err != nil {
+		return
+	}
+	hasTarget := make(map[string]bool)
+	for _, target := range targets {
+		target = strings.ToLower(target)
+		hasTarget[target] = true
+		if _, ok := domains[target]; !ok {
+			drift.OrphanTargets = append(drift.OrphanTargets, target)
+		}
+	}
+	for name, k := range domains {
+		if k.Published && !k.Redirect && !hasTarget[name] {
+			drift.MissingTargets = append(drift.MissingTargets, k.Site)
+		}
+	}
+
+	sort.Slice(drift.MissingRecords, func(i, j int) bool {
+		return drift.MissingRecords[i].Name < drift.MissingRecords[j].Name
+	})
+	sort.Ints(drift.MissingTargets)
+	sort.Strings(drift.OrphanTargets)
+	return
+}
+
+// fixDrift does what it can to make things as they should be. sites whose
+// files are gone are published again.
+func fixDrift(pg *sqlx.DB, drift Drift) (failures int) {
+	fail := func(err error, what, name string) {
+		failures++
+		log.Warn().
+			Err(err).
+			Str(what, name).
+			Msg("couldn't fix drift")
+	}
+
+	for _, record := range append(drift.MissingRecords, drift.WrongRecords...) {
+		if err := dns.EnsureRecord(record); err != nil {
+			fail(err, "record", record.Name)
+		}
+	}
+	for _, record := range drift.OrphanRecords {
+		if err := dns.RemoveRecord(record.Name); err != nil {
+			fail(err, "record", record.Name)
+		}
+	}
+	for _, target := range drift.OrphanTargets {
+		if err := removeOrphanTarget(pg, target); err != nil {
+			fail(err, "target", target)
+		}
+	}
+	for _, siteId := range drift.MissingTargets {
+		if _, err := enqueueSitePublish(pg, siteId, "reconcile"); err != nil {
+			fail(err, "site", strconv.Itoa(siteId))
+		}
+	}
+	return
+}
+
+// removeOrphanTarget removes a target unless, after waiting for whatever
+// was being done to it, like a rename moving its files away, some site or
+// preview has the domain.
+func removeOrphanTarget(pg *sqlx.DB, domain string) error {
+	unlock := lockSiteActivation(domain)
+	defer unlock()
+
+	var known bool
+	err := pg.Get(&known, `
+SELECT exists (SELECT 1 FROM sites WHERE lower(domain) = $1)
+    OR exists (SELECT 1 FROM previews WHERE lower(domain) = $1)
+    OR exists (SELECT 1 FROM site_redirects WHERE lower(domain) = $1)
+    `, domain)
+	if err != nil || known {
+		return err
+	}
+	return storage.RemoveTarget(domain)
+}
+
+func reconcile(pg *sqlx.DB, fix bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while reconciling: %v", r)
+		}
+	}()
+
+	drift, err := findDrift(pg)
+	if err != nil {
+		return err
+	}
+	if drift.Empty() {
+		log.Debug().Msg("no drift between sites, dns and storage")
+		return nil
+	}
+
+	log.Warn().
+		Strs("missing records", recordNames(drift.MissingRecords)).
+		Strs("wrong records", recordNames(drift.WrongRecords)).
+		Strs("orphan records", recordNames(drift.OrphanRecords)).
+		Ints("missing targets", drift.MissingTargets).
+		Strs("orphan targets", drift.OrphanTargets).
+		Bool("fix", fix).
+		Msg("found drift between sites, dns and storage")
+
+	if fix {
+		if failures := fixDrift(pg, drift); failures > 0 {
+			log.Warn().Int("failures", failures).Msg("drift was not entirely fixed")
+		}
+	}
+	return nil
+}
+
+func recordNames(records []DNSRecord) []string {
+	names := make([]string, len(records))
+	for i, record := range records {
+		names[i] = record.Name
+	}
+	return names
+}
+
+func startReconciler(pg *sqlx.DB) {
+	go func() {
+		for {
+			time.Sleep(reconcileInterval)
+			err := reconcile(pg, reconcileFix)
+			if err != nil {
+				log.Error().
+					Err(err).
+					Msg("failed to reconcile dns and storage")
+			}
+		}
+	}()
+}
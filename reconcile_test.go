@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCompareDrift(t *testing.T) {
+	defer func(m, s string, st StorageBackend, d DNSProvider) {
+		mainHostname, serviceURL, storage, dns = m, s, st, d
+	}(mainHostname, serviceURL, storage, dns)
+
+	dir, err := ioutil.TempDir("", "sitios-sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tree := writeTree(t, map[string]string{"index.html": "hello"})
+	defer os.RemoveAll(tree)
+
+	mainHostname = "sitios.xyz"
+	serviceURL = "https://app.sitios.xyz"
+	storage = localStorage{dir: dir}
+	dns = newDNSProvider("memory")
+	ours := storage.CNAMETarget()
+
+	for _, domain := range []string{"blog.sitios.xyz", "wrong.sitios.xyz", "custom.com", "deleted.com"} {
+		if err := storage.EnsureTarget(domain); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.UploadTree(domain, "1", tree); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Activate(domain, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Redirect("old.sitios.xyz", "blog.sitios.xyz"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, record := range []DNSRecord{
+		{Type: "CNAME", Name: "blog.sitios.xyz", Content: ours},
+		{Type: "CNAME", Name: "old.sitios.xyz", Content: ours},
+		{Type: "CNAME", Name: "wrong.sitios.xyz", Content: "somewhere.else"},
+		{Type: "CNAME", Name: "gone.sitios.xyz", Content: ours},
+		// not ours
+		{Type: "CNAME", Name: "alias.sitios.xyz", Content: ours},
+		{Type: "CNAME", Name: "app.sitios.xyz", Content: ours},
+		{Type: "CNAME", Name: "www.sitios.xyz", Content: "sitios.xyz"},
+		{Type: "CNAME", Name: "s1._domainkey.sitios.xyz", Content: "s1.mail.example.com"},
+		{Type: "TXT", Name: "gone.sitios.xyz", Content: "text"},
+		{Type: "CNAME", Name: "blog.example.com", Content: ours},
+	} {
+		if err := dns.EnsureRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	known := []knownDomain{
+		{Domain: "blog.sitios.xyz", Site: 1, Published: true},
+		{Domain: "old.sitios.xyz", Site: 1, Published: true, Redirect: true},
+		{Domain: "wrong.sitios.xyz", Site: 2, Published: true},
+		{Domain: "missing.sitios.xyz", Site: 3, Published: true},
+		{Domain: "draft.sitios.xyz", Site: 4},
+		{Domain: "custom.com", Site: 5, Published: true},
+	}
+
+	drift, err := compareDrift(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := recordNames(drift.MissingRecords); !sameNames(names, []string{"missing.sitios.xyz"}) {
+		t.Errorf("missing records are %v", names)
+	}
+	if names := recordNames(drift.WrongRecords); !sameNames(names, []string{"wrong.sitios.xyz"}) ||
+		drift.WrongRecords[0].Content != ours {
+		t.Errorf("wrong records are %v", drift.WrongRecords)
+	}
+	if names := recordNames(drift.OrphanRecords); !sameNames(names, []string{"gone.sitios.xyz"}) ||
+		drift.OrphanRecords[0].Type != "CNAME" {
+		t.Errorf("orphan records are %v", drift.OrphanRecords)
+	}
+	if len(drift.MissingTargets) != 1 || drift.MissingTargets[0] != 3 {
+		t.Errorf("missing targets are %v", drift.MissingTargets)
+	}
+	if !sameNames(drift.OrphanTargets, []string{"deleted.com"}) {
+		t.Errorf("orphan targets are %v", drift.OrphanTargets)
+	}
+
+	// missing targets need a publish and orphan targets are checked
+	// again before being removed, both need the database
+	drift.MissingTargets = nil
+	drift.OrphanTargets = nil
+	if failures := fixDrift(nil, drift); failures > 0 {
+		t.Fatalf("%d failures fixing drift", failures)
+	}
+	drift, err = compareDrift(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift.MissingRecords) != 0 || len(drift.WrongRecords) != 0 ||
+		len(drift.OrphanRecords) != 0 {
+		t.Errorf("drift after fixing: %+v", drift)
+	}
+
+	// the records that aren't ours are all still there
+	left := make(map[string]bool)
+	records, _ := dns.ListRecords()
+	for _, record := range records {
+		left[record.Name] = true
+	}
+	for _, name := range []string{"alias.sitios.xyz", "app.sitios.xyz", "www.sitios.xyz",
+		"s1._domainkey.sitios.xyz", "blog.example.com"} {
+		if !left[name] {
+			t.Errorf("%s was removed", name)
+		}
+	}
+}
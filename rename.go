@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// a site can change its domain keeping everything else. its files are
+// moved to the new domain and the old one can be left redirecting there,
+// in which case it is kept in site_redirects until the site is deleted.
+//
+// the database is changed first and the files moved after, with both
+// domains locked so no publish or rollback activates anything on them in
+// the meantime. those that were waiting see the site is somewhere else
+// and give up. if the files can't be moved the database is changed back.
+
+// ErrSiteMoved is returned when the domain of a site changes while
+// something is being done to it.
+var ErrSiteMoved = errors.New("the site was moved to another domain in the meantime")
+
+// renaming is what renameSite changed in the database, so it can be undone.
+type renaming struct {
+	Domain         string  `db:"domain"`
+	DomainVerified bool    `db:"domain_verified"`
+	OwnerProven    bool    `db:"owner_proven"`
+	VerifyToken    *string `db:"verify_token"`
+	Published      bool    `db:"published"`
+
+	wasRedirect bool     // the new domain was redirecting to the site
+	redirect    bool     // the old domain now redirects to the new
+	others      []string // other domains redirecting to the site
+}
+
+// renameSite changes the domain of a site. custom domains need the same
+// proof as when creating a site, until it is seen the pending claim is
+// returned and nothing changes.
+func renameSite(pg *sqlx.DB, user string, siteId int, domain string, redirect bool) (site Site, claim *DomainClaim, err error) {
+	domain, err = cleanDomain(domain)
+	if err != nil {
+		return
+	}
+	old, err := fetchSite(pg, user, siteId)
+	if err != nil {
+		return
+	}
+	if old.Domain == domain {
+		return old, nil, nil
+	}
+
+	var token *string
+	if isCustomDomain(domain) {
+		var t string
+		t, claim, err = proveDomain(pg, user, domain)
+		if err != nil || claim != nil {
+			return
+		}
+		token = &t
+	}
+
+	unlock := lockSiteActivations(old.Domain, domain)
+	defer unlock()
+
+	prev, err := saveRename(pg, user, siteId, old.Domain, domain, token, redirect)
+	if err != nil {
+		return
+	}
+
+	if token != nil && !prev.wasRedirect {
+		// anything there was left by the sites moveSquatters moved away
+		err = storage.RemoveTarget(domain)
+	}
+	if err == nil && prev.Published {
+		err = storage.MoveTarget(old.Domain, domain)
+	}
+	if err != nil {
+		// the backends only delete the old files once everything is
+		// copied, so the site can go back to where they are
+		if uerr := undoRename(pg, siteId, domain, prev); uerr != nil {
+			log.Error().
+				Err(uerr).
+				Int("site", siteId).
+				Str("from", old.Domain).
+				Str("to", domain).
+				Msg("couldn't undo rename after failing to move files")
+		}
+		return
+	}
+
+	// from here on the site is at the new domain, so what fails is only
+	// reported. the reconciler fixes the dns records.
+	var failed []string
+	if prev.Published && !prev.redirect {
+		if err := storage.RemoveTarget(old.Domain); err != nil {
+			log.Warn().Err(err).Str("domain", old.Domain).Msg("couldn't remove old target")
+			failed = append(failed, "removing the files of "+old.Domain)
+		}
+	}
+	var redirects []string
+	if prev.redirect {
+		redirects = append(redirects, old.Domain)
+	}
+	for _, from := range append(redirects, prev.others...) {
+		if err := storage.Redirect(from, domain); err != nil {
+			log.Warn().Err(err).Str("from", from).Str("to", domain).Msg("couldn't redirect")
+			failed = append(failed, "redirecting "+from)
+		}
+	}
+
+	if prev.Published && !isCustomDomain(domain) {
+		err := setupSubdomainDNS(strings.TrimSuffix(domain, "."+mainHostname))
+		if err != nil {
+			log.Warn().Err(err).Str("domain", domain).Msg("couldn't set dns record")
+			failed = append(failed, "setting the dns record of "+domain)
+		}
+	}
+	if !prev.redirect && !isCustomDomain(old.Domain) {
+		err := removeSubdomainDNS(old.Domain)
+		if err != nil {
+			log.Warn().Err(err).Str("domain", old.Domain).Msg("couldn't remove dns record")
+			failed = append(failed, "removing the dns record of "+old.Domain)
+		}
+	}
+	if token != nil {
+		err = forgetClaim(pg, user, domain)
+		if err != nil {
+			return
+		}
+	}
+	if len(failed) > 0 {
+		err = errors.New("the site was renamed, but these failed: " +
+			strings.Join(failed, ", "))
+		return
+	}
+
+	site, err = fetchSite(pg, user, siteId)
+	return
+}
+
+// saveRename changes the domain of the site in the database and returns
+// what it was before.
+func saveRename(pg *sqlx.DB, user string, siteId int, from, domain string, token *string, redirect bool) (prev renaming, err error) {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	err = tx.Get(&prev, `
+SELECT domain, domain_verified, owner_proven, verify_token,
+  live_build IS NOT NULL AS published
+FROM sites
+WHERE owner = $1 AND id = $2
+FOR UPDATE
+    `, user, siteId)
+	if err != nil {
+		return
+	}
+	if prev.Domain != from {
+		err = ErrSiteMoved
+		return
+	}
+
+	// previews and the redirects of other sites are served from their
+	// own targets, which moving the files here would overwrite
+	taken, err := domainInUse(tx, domain, siteId)
+	if err != nil {
+		return
+	}
+	if taken {
+		err = ErrDomainTaken
+		return
+	}
+
+	if token != nil {
+		_, err = moveSquatters(tx, user, domain)
+		if err != nil {
+			return
+		}
+	}
+
+	// renaming back to a domain that was redirecting here
+	res, err := tx.Exec(`
+DELETE FROM site_redirects WHERE domain = $2 AND site = $1
+    `, siteId, domain)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		prev.wasRedirect = true
+	}
+
+	_, err = tx.Exec(`
+UPDATE sites
+SET domain = $2, domain_verified = true, owner_proven = $3::text IS NOT NULL,
+  verify_token = coalesce($3, verify_token)
+WHERE id = $1
+    `, siteId, domain, token)
+	if pqerr, ok := err.(*pq.Error); ok && pqerr.Code == "23505" {
+		err = ErrDomainTaken
+	}
+	if err != nil {
+		return
+	}
+
+	// there is nothing to redirect from if it was never published
+	prev.redirect = redirect && prev.Published
+	if prev.redirect {
+		_, err = tx.Exec(`
+INSERT INTO site_redirects (domain, site) VALUES ($2, $1)
+ON CONFLICT (domain) DO UPDATE SET site = excluded.site
+        `, siteId, from)
+		if err != nil {
+			return
+		}
+	}
+
+	// the domains that redirected to the old one must now go to the new
+	err = tx.Select(&prev.others, `
+SELECT domain FROM site_redirects WHERE site = $1 AND domain != $2
+    `, siteId, from)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// undoRename puts back in the database what saveRename changed.
+func undoRename(pg *sqlx.DB, siteId int, domain string, prev renaming) error {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+UPDATE sites
+SET domain = $2, domain_verified = $3, owner_proven = $4, verify_token = $5
+WHERE id = $1 AND domain = $6
+    `, siteId, prev.Domain, prev.DomainVerified, prev.OwnerProven,
+		prev.VerifyToken, domain)
+	if err != nil {
+		return err
+	}
+	if prev.redirect {
+		_, err = tx.Exec(`
+DELETE FROM site_redirects WHERE domain = $2 AND site = $1
+        `, siteId, prev.Domain)
+		if err != nil {
+			return err
+		}
+	}
+	if prev.wasRedirect {
+		_, err = tx.Exec(`
+INSERT INTO site_redirects (domain, site) VALUES ($2, $1)
+ON CONFLICT (domain) DO NOTHING
+        `, siteId, domain)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// checkSiteDomain tells if the site is still at domain, for those who
+// waited on lockSiteActivation while it could have been renamed.
+func checkSiteDomain(pg *sqlx.DB, siteId int, domain string) error {
+	var current string
+	err := pg.Get(&current, `
+SELECT domain FROM sites WHERE id = $1
+    `, siteId)
+	if err == sql.ErrNoRows || (err == nil && current != domain) {
+		return ErrSiteMoved
+	}
+	return err
+}
+
+func siteRedirects(pg *sqlx.DB, siteId int) (domains []string, err error) {
+	err = pg.Select(&domains, `
+SELECT domain FROM site_redirects WHERE site = $1
+    `, siteId)
+	return
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"mime"
 	"net/http"
 	"os"
@@ -22,20 +24,35 @@ var ms3, _ = minio.New(
 	true,
 )
 
-func ensureBucket(bucketName string) error {
-	exists, err := ms3.BucketExists(bucketName)
+// s3Storage stores each site in an S3 bucket named after its domain,
+// configured as a public website. versions are kept under the _versions/
+// prefix, hidden from visitors, and the live one is copied to the root of
+// the bucket, since that is where S3 serves the website from. the copy
+// happens entirely inside S3 and only after the version was fully
+// uploaded, so the window in which visitors can see a mix of two versions
+// is as short as we can make it. if some file can't be copied the previous
+// version is copied back, and only if that also fails is the mix left
+// there, which the error then says.
+type s3Storage struct {
+	client *minio.Client
+}
+
+const s3VersionsPrefix = "_versions/"
+
+func (s s3Storage) EnsureTarget(bucketName string) error {
+	exists, err := s.client.BucketExists(bucketName)
 	if err != nil {
 		return err
 	}
 
 	if !exists {
-		err = ms3.MakeBucket(bucketName, "us-east-1")
+		err = s.client.MakeBucket(bucketName, "us-east-1")
 		if err != nil {
 			return err
 		}
 	}
 
-	err = ms3.SetBucketPolicy(bucketName, `{
+	err = s.client.SetBucketPolicy(bucketName, `{
   "Version":"2012-10-17",
   "Statement":[
     {
@@ -44,6 +61,14 @@ func ensureBucket(bucketName string) error {
       "Principal": "*",
       "Action":["s3:GetObject"],
       "Resource":["arn:aws:s3:::`+bucketName+`/*"]
+    },
+    {
+      "Sid":"HideVersions",
+      "Effect":"Deny",
+      "Principal": "*",
+      "Action":["s3:GetObject"],
+      "Resource":["arn:aws:s3:::`+bucketName+`/`+s3VersionsPrefix+`*"],
+      "Condition":{"StringEquals":{"aws:PrincipalType":"Anonymous"}}
     }
   ]
 }`)
@@ -59,11 +84,11 @@ func ensureBucket(bucketName string) error {
 	return nil
 }
 
-func removeBucket(bucketName string) error {
-	emptyBucket(bucketName)
+func (s s3Storage) RemoveTarget(bucketName string) error {
+	s.removePrefix(bucketName, "")
 
-	if err := ms3.RemoveBucket(bucketName); err != nil {
-		exists, err := ms3.BucketExists(bucketName)
+	if err := s.client.RemoveBucket(bucketName); err != nil {
+		exists, err := s.client.BucketExists(bucketName)
 		if err != nil {
 			return err
 		}
@@ -77,82 +102,297 @@ func removeBucket(bucketName string) error {
 	return nil
 }
 
-func emptyBucket(bucketName string) {
-	objectsCh := make(chan string)
+// Targets only lists the buckets with versions, which are surely ours.
+func (s s3Storage) Targets() (targets []string, err error) {
+	buckets, err := s.client.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range buckets {
+		versions, err := s.Versions(bucket.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) > 0 {
+			targets = append(targets, bucket.Name)
+		}
+	}
+	return
+}
+
+func (s s3Storage) MoveTarget(from, to string) error {
+	err := s.EnsureTarget(to)
+	if err != nil {
+		return err
+	}
+
+	var files []treeFile
 	doneCh := make(chan struct{})
+	for object := range s.client.ListObjects(from, "", true, doneCh) {
+		if object.Err != nil {
+			close(doneCh)
+			return object.Err
+		}
+		files = append(files, treeFile{key: object.Key})
+	}
+	close(doneCh)
+
+	_, err = uploadFiles(files, func(file treeFile) (uploadOutcome, error) {
+		return uploadAdded, s.copyObjectBetween(from, file.key, to, file.key)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.removePrefix(from, "")
+	return nil
+}
+
+func (s s3Storage) Redirect(from, to string) error {
+	s.removePrefix(from, "")
+	return putBucketWebsite(from, `
+<WebsiteConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <RedirectAllRequestsTo>
+    <HostName>`+to+`</HostName>
+    <Protocol>https</Protocol>
+  </RedirectAllRequestsTo>
+</WebsiteConfiguration>
+`)
+}
+
+func (s s3Storage) UploadTree(bucketName, version, dirname string) (UploadResult, error) {
+	live, err := s.listETags(bucketName, "")
+	if err != nil {
+		return UploadResult{}, err
+	}
 
+	prefix := s3VersionsPrefix + version + "/"
+	result, err := uploadTree(dirname, func(file treeFile) (uploadOutcome, error) {
+		hash, err := fileMD5(file.path)
+		if err != nil {
+			return 0, err
+		}
+		etag, exists := live[file.key]
+		if exists && etag == hash {
+			return uploadUnchanged, s.copyObject(bucketName, file.key, prefix+file.key)
+		}
+
+		_, err = s.client.FPutObject(bucketName, prefix+file.key, file.path,
+			minio.PutObjectOptions{
+				ContentType:  mimetype(file.path),
+				StorageClass: "REDUCED_REDUNDANCY",
+			})
+		if err != nil {
+			return 0, err
+		}
+
+		if exists {
+			return uploadChanged, nil
+		}
+		return uploadAdded, nil
+	})
+
+	for key := range live {
+		if !result.Keys[key] {
+			result.Removed++
+		}
+	}
+	return result, err
+}
+
+func (s s3Storage) Activate(bucketName, version string) error {
+	prefix := s3VersionsPrefix + version + "/"
+	stored, err := s.listETags(bucketName, prefix)
+	if err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return errors.New("version " + version + " not found")
+	}
+
+	live, err := s.listETags(bucketName, "")
+	if err != nil {
+		return err
+	}
+
+	// copy to the root what is different there
+	var files []treeFile
+	for key, etag := range stored {
+		if live[key] != etag {
+			files = append(files, treeFile{key: key})
+		}
+	}
+	_, err = uploadFiles(files, func(file treeFile) (uploadOutcome, error) {
+		return uploadChanged, s.copyObject(bucketName, prefix+file.key, file.key)
+	})
+	if err != nil {
+		rerr := s.restoreLive(bucketName, version, live, files)
+		if rerr != nil {
+			return errors.New(err.Error() + "; the live files are now a mix of " +
+				"two versions, as restoring the previous one failed: " + rerr.Error())
+		}
+		return err
+	}
+
+	// then remove from the root what is not in this version
+	objectsCh := make(chan string)
 	go func() {
 		defer close(objectsCh)
-		for object := range ms3.ListObjects(bucketName, "", true, doneCh) {
-			if object.Err != nil {
-				log.Error().
-					Err(object.Err).
-					Str("obj", object.Key).
-					Msg("error listing object")
+		for key := range live {
+			if _, ok := stored[key]; !ok {
+				objectsCh <- key
 			}
-			objectsCh <- object.Key
 		}
 	}()
+	s.removeObjects(bucketName, objectsCh)
 
-	errorCh := ms3.RemoveObjects(bucketName, objectsCh)
-	for e := range errorCh {
-		log.Warn().
-			Err(e.Err).
-			Str("obj", e.ObjectName).
-			Str("bucket", bucketName).
-			Msg("failed to remove object from bucket")
+	return nil
+}
+
+// restoreLive puts back at the root the files that were live before an
+// activation that failed after copying some of files there. they come from
+// the stored version that has exactly what was live.
+func (s s3Storage) restoreLive(bucketName, failed string, live map[string]string, files []treeFile) error {
+	// what was live is copied back, what is new is removed
+	var back []treeFile
+	var added []string
+	for _, file := range files {
+		if _, ok := live[file.key]; ok {
+			back = append(back, file)
+		} else {
+			added = append(added, file.key)
+		}
 	}
+	objectsCh := make(chan string)
+	go func() {
+		defer close(objectsCh)
+		for _, key := range added {
+			objectsCh <- key
+		}
+	}()
+	s.removeObjects(bucketName, objectsCh)
+	if len(back) == 0 {
+		return nil
+	}
+
+	versions, err := s.Versions(bucketName)
+	if err != nil {
+		return err
+	}
+	previous := ""
+	for _, version := range versions {
+		if version == failed {
+			continue
+		}
+		stored, err := s.listETags(bucketName, s3VersionsPrefix+version+"/")
+		if err != nil {
+			return err
+		}
+		if sameETags(stored, live) {
+			previous = version
+			break
+		}
+	}
+	if previous == "" {
+		return errors.New("no stored version has what was live")
+	}
+
+	prefix := s3VersionsPrefix + previous + "/"
+	_, err = uploadFiles(back, func(file treeFile) (uploadOutcome, error) {
+		return uploadChanged, s.copyObject(bucketName, prefix+file.key, file.key)
+	})
+	return err
 }
 
-func uploadFilesToBucket(bucketName, dirname string) error {
-	uploaded := make(map[string]bool)
-	err := filepath.Walk(
-		dirname, func(filename string, info os.FileInfo, err error) error {
+func sameETags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, etag := range a {
+		if b[key] != etag {
+			return false
+		}
+	}
+	return true
+}
 
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
+func (s s3Storage) Versions(bucketName string) (versions []string, err error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range s.client.ListObjects(bucketName, s3VersionsPrefix, false, doneCh) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		version := strings.TrimSuffix(
+			strings.TrimPrefix(object.Key, s3VersionsPrefix), "/")
+		if version != "" {
+			versions = append(versions, version)
+		}
+	}
+	return
+}
 
-			objectname, _ := filepath.Rel(dirname, filename)
-			_, err = ms3.FPutObject(bucketName, objectname, filename,
-				minio.PutObjectOptions{
-					ContentType:  mimetype(filename),
-					StorageClass: "REDUCED_REDUNDANCY",
-				})
-			if err != nil {
-				return err
-			}
+func (s s3Storage) ReadLive(bucketName, key string) (io.ReadCloser, error) {
+	return s.client.GetObject(bucketName, key, minio.GetObjectOptions{})
+}
 
-			uploaded[objectname] = true
-			return nil
-		})
+func (s s3Storage) RemoveVersion(bucketName, version string) error {
+	s.removePrefix(bucketName, s3VersionsPrefix+version+"/")
+	return nil
+}
+
+// listETags returns the ETag of each object under prefix, keyed by their
+// name without the prefix. when prefix is empty it lists the live version,
+// skipping everything under s3VersionsPrefix.
+func (s s3Storage) listETags(bucketName, prefix string) (map[string]string, error) {
+	etags := make(map[string]string)
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range s.client.ListObjects(bucketName, prefix, true, doneCh) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if prefix == "" && strings.HasPrefix(object.Key, s3VersionsPrefix) {
+			continue
+		}
+		etags[strings.TrimPrefix(object.Key, prefix)] = strings.Trim(object.ETag, `"`)
+	}
+	return etags, nil
+}
+
+func (s s3Storage) copyObject(bucketName, src, dst string) error {
+	return s.copyObjectBetween(bucketName, src, bucketName, dst)
+}
+
+func (s s3Storage) copyObjectBetween(srcBucket, src, dstBucket, dst string) error {
+	dstInfo, err := minio.NewDestinationInfo(dstBucket, dst, nil, nil)
 	if err != nil {
 		return err
 	}
+	return s.client.CopyObject(dstInfo, minio.NewSourceInfo(srcBucket, src, nil))
+}
 
-	// remove all objects which were not uploaded just now
+func (s s3Storage) removePrefix(bucketName, prefix string) {
 	objectsCh := make(chan string)
 	doneCh := make(chan struct{})
 	go func() {
 		defer close(objectsCh)
-		for object := range ms3.ListObjects(bucketName, "", true, doneCh) {
+		for object := range s.client.ListObjects(bucketName, prefix, true, doneCh) {
 			if object.Err != nil {
 				log.Error().
 					Err(object.Err).
 					Str("obj", object.Key).
 					Msg("error listing object")
+				continue
 			}
-
-			if _, wasUploaded := uploaded[object.Key]; !wasUploaded {
-				objectsCh <- object.Key
-			}
+			objectsCh <- object.Key
 		}
 	}()
+	s.removeObjects(bucketName, objectsCh)
+}
 
-	removeErrCh := ms3.RemoveObjects(bucketName, objectsCh)
+func (s s3Storage) removeObjects(bucketName string, objectsCh <-chan string) {
+	removeErrCh := s.client.RemoveObjects(bucketName, objectsCh)
 	for e := range removeErrCh {
 		log.Warn().
 			Err(e.Err).
@@ -160,8 +400,10 @@ func uploadFilesToBucket(bucketName, dirname string) error {
 			Str("bucket", bucketName).
 			Msg("failed to remove object from bucket")
 	}
+}
 
-	return nil
+func (s s3Storage) CNAMETarget() string {
+	return "s3-website-us-east-1.amazonaws.com"
 }
 
 func mimetype(filename string) string {
@@ -169,11 +411,7 @@ func mimetype(filename string) string {
 }
 
 func makeBucketAWebsite(bucketName string) error {
-	keys := s3.Keys{
-		AccessKey: AWS_KEY_ID,
-		SecretKey: AWS_SECRET_KEY,
-	}
-	data := strings.NewReader(`
+	return putBucketWebsite(bucketName, `
 <WebsiteConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
   <IndexDocument>
     <Suffix>index.html</Suffix>
@@ -183,6 +421,14 @@ func makeBucketAWebsite(bucketName string) error {
   </ErrorDocument>
 </WebsiteConfiguration>
 `)
+}
+
+func putBucketWebsite(bucketName, config string) error {
+	keys := s3.Keys{
+		AccessKey: AWS_KEY_ID,
+		SecretKey: AWS_SECRET_KEY,
+	}
+	data := strings.NewReader(config)
 	r, _ := http.NewRequest(
 		"PUT", "http://"+bucketName+".s3.amazonaws.com/?website", data)
 	r.ContentLength = int64(data.Len())
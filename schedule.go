@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sites with a publish_every are republished automatically. the scheduler
+// doesn't publish anything itself, it just queues jobs for the sites that
+// are due, so scheduled runs never overlap with any other run of the same
+// site.
+
+const minPublishEvery = 15 // minutes
+
+// scheduleJitter is the fraction of publish_every randomly added to each
+// interval, so sites created together don't all publish together forever.
+const scheduleJitter = 0.1
+
+func startScheduler(pg *sqlx.DB) {
+	limit := envInt("SCHEDULED_PUBLISH_LIMIT", 2)
+
+	go func() {
+		for {
+			err := scheduleDuePublishes(pg, limit)
+			if err != nil {
+				log.Error().
+					Err(err).
+					Msg("failed to schedule publishes")
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// scheduleDuePublishes queues jobs for sites whose time has come, but
+// never keeps more than limit scheduled jobs queued or running at once.
+func scheduleDuePublishes(pg *sqlx.DB, limit int) error {
+	var due []struct {
+		Id   int  `db:"id"`
+		Busy bool `db:"busy"`
+	}
+	err := pg.Select(&due, `
+SELECT id, EXISTS (
+  SELECT 1 FROM publish_jobs
+  WHERE site = sites.id AND state IN ('queued', 'running')
+) AS busy
+FROM sites
+WHERE publish_every IS NOT NULL AND next_publish_at <= now()
+ORDER BY next_publish_at
+    `)
+	if err != nil {
+		return err
+	}
+
+	var pending int
+	err = pg.Get(&pending, `
+SELECT count(*) FROM publish_jobs
+WHERE origin = 'schedule' AND state IN ('queued', 'running')
+    `)
+	if err != nil {
+		return err
+	}
+
+	for _, site := range due {
+		if site.Busy {
+			// a run is already happening, this one can wait for the next turn
+			log.Debug().Int("site", site.Id).Msg("skipping scheduled publish")
+		} else {
+			if pending >= limit {
+				// the rest stays due and will be picked in the next pass
+				break
+			}
+
+			_, err = enqueueSitePublish(pg, site.Id, "schedule")
+			if err != nil {
+				return err
+			}
+			pending++
+		}
+
+		_, err = pg.Exec(`
+UPDATE sites
+SET next_publish_at = now() + make_interval(mins => publish_every) * (1 + $2 * random())
+WHERE id = $1
+        `, site.Id, scheduleJitter)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// siteServer answers requests for sites stored by localStorage, picking
+// the site directory from the Host header and following the same index
+// and error document rules we configure on S3 website buckets.
+// requests for any other host are passed to next.
+type siteServer struct {
+	dir  string
+	next http.Handler
+}
+
+func (s siteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if host == serviceHostname() || validDomain(host) != nil {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+
+	if to, err := ioutil.ReadFile(filepath.Join(s.dir, ".redirects", host)); err == nil {
+		// like S3 with RedirectAllRequestsTo
+		http.Redirect(w, r, "https://"+string(to)+r.URL.RequestURI(),
+			http.StatusMovedPermanently)
+		return
+	}
+
+	root := filepath.Join(s.dir, host)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+
+	upath := path.Clean("/" + r.URL.Path)
+	name := filepath.Join(root, filepath.FromSlash(upath))
+	info, err := os.Stat(name)
+	if err == nil && info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// like S3, send "/posts" to "/posts/"
+			to := upath + "/"
+			if r.URL.RawQuery != "" {
+				to += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, to, http.StatusMovedPermanently)
+			return
+		}
+		name = filepath.Join(name, "index.html")
+		info, err = os.Stat(name)
+	}
+	if err != nil || info.IsDir() {
+		serveSiteError(w, r, root)
+		return
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		serveSiteError(w, r, root)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func serveSiteError(w http.ResponseWriter, r *http.Request, root string) {
+	f, err := os.Open(filepath.Join(root, "error", "index.html"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(404)
+	io.Copy(w, f)
+}
+
+func serviceHostname() string {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSiteServer(t *testing.T) {
+	defer func(s string) { serviceURL = s }(serviceURL)
+	serviceURL = "https://app.sitios.xyz"
+
+	dir, err := ioutil.TempDir("", "sitios-sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := localStorage{dir: dir}
+
+	for domain, files := range map[string]map[string]string{
+		"blog.com": {
+			"index.html":       "home",
+			"posts/index.html": "posts",
+			"posts/first.html": "first",
+			"error/index.html": "not here",
+			"empty/.keep":      "",
+		},
+		"plain.com": {"index.html": "plain"},
+	} {
+		tree := writeTree(t, files)
+		defer os.RemoveAll(tree)
+		if err := l.EnsureTarget(domain); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := l.UploadTree(domain, "1", tree); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Activate(domain, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Redirect("old.com", "blog.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(299)
+	})
+	server := siteServer{dir: dir, next: next}
+
+	for _, test := range []struct {
+		host     string
+		target   string
+		status   int
+		body     string
+		location string
+	}{
+		{"blog.com", "/", 200, "home", ""},
+		{"Blog.com:8080", "/", 200, "home", ""},
+		{"blog.com", "/posts/", 200, "posts", ""},
+		{"blog.com", "/posts/first.html", 200, "first", ""},
+		{"blog.com", "/posts", 301, "", "/posts/"},
+		{"blog.com", "/posts?page=2", 301, "", "/posts/?page=2"},
+		{"blog.com", "/posts/../posts", 301, "", "/posts/"},
+		{"blog.com", "/nothing", 404, "not here", ""},
+		{"blog.com", "/empty/", 404, "not here", ""},
+		{"plain.com", "/nothing", 404, "404 page not found\n", ""},
+		// nothing outside the site
+		{"blog.com", "/../plain.com/index.html", 404, "not here", ""},
+		{"blog.com", "/../../secret", 404, "not here", ""},
+		{"blog.com", "/%2e%2e/secret", 404, "not here", ""},
+		// redirects keep the path
+		{"old.com", "/posts/first.html?a=b", 301, "", "https://blog.com/posts/first.html?a=b"},
+		// not ours
+		{"app.sitios.xyz", "/", 299, "", ""},
+		{"unknown.com", "/", 299, "", ""},
+		{"..", "/secret", 299, "", ""},
+	} {
+		r := httptest.NewRequest("GET", test.target, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s%s: status %d, not %d", test.host, test.target, w.Code, test.status)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s%s: body %q, not %q", test.host, test.target, w.Body.String(), test.body)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("%s%s: location %q, not %q", test.host, test.target, location, test.location)
+		}
+	}
+}
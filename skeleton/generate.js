@@ -1,34 +1,44 @@
+const fs = require('fs')
 const path = require('path')
 const {init, end, generatePage, plug, postprocess, copyStatic} = require('sitio')
 
-const plugins = {
-  'url:html': 'sitio-url',
-  'url:markdown': 'sitio-url',
-  'trello:list': 'sitio-trello/list',
-  'trello:board': 'sitio-trello/board',
-  'evernote:note': 'sitio-evernote/note',
-  'dropbox:file': 'sitio-dropbox/file',
-  'dropbox:folder': 'sitio-dropbox/folder',
-  'medium:profile': 'sitio-medium/list'
-}
+// see sitioPlugins in publish.go
+const plugins = {{ json .Plugins }}
 
-async function main (globals, sources) {
+// a source that fails doesn't stop the others, we just report how each
+// one went in statusFile and let the Go side decide what to do.
+async function main (globals, sources, targetDir, statusFile) {
   await init(globals)
 
+  let statuses = []
   for (let i = 0; i < sources.length; i++) {
-    let {provider, root, data} = sources[i]
+    let {id, provider, root, data} = sources[i]
+
+    let status = {id, provider, root, status: 'ok', files: []}
+    statuses.push(status)
 
     let pluginName = plugins[provider]
-    if (!pluginName) return
-  
+    if (!pluginName) {
+      status.status = 'failed'
+      status.error = 'unknown provider ' + provider
+      fs.writeFileSync(statusFile, JSON.stringify(statuses))
+      continue
+    }
+
+    let before = listFiles(targetDir)
     try {
       await plug(pluginName, root, data)
     } catch (err) {
       console.log('error running source', pluginName, 'on', root, 'with', data, err)
-      process.exit(1)
-      return
+      status.status = 'failed'
+      status.error = (err && err.message) || String(err)
     }
+
+    let after = listFiles(targetDir)
+    status.files = Object.keys(after).filter(key => before[key] !== after[key])
+    fs.writeFileSync(statusFile, JSON.stringify(statuses))
   }
+  fs.writeFileSync(statusFile, JSON.stringify(statuses))
 
   postprocess('sitio-error')
 
@@ -41,10 +51,35 @@ async function main (globals, sources) {
   }
 }
 
+// listFiles maps every file under dir, by its path relative to base, to
+// something that changes when the file is written.
+function listFiles (dir, base = dir, files = {}) {
+  let names
+  try {
+    names = fs.readdirSync(dir)
+  } catch (err) {
+    return files
+  }
+
+  names.forEach(name => {
+    let full = path.join(dir, name)
+    let stat = fs.statSync(full)
+    if (stat.isDirectory()) {
+      listFiles(full, base, files)
+    } else {
+      let key = path.relative(base, full).split(path.sep).join('/')
+      files[key] = stat.mtimeMs + ':' + stat.size
+    }
+  })
+  return files
+}
+
 try {
   main(
     {{ json .Globals }},
-    {{ json .Sources }}
+    {{ json .Sources }},
+    {{ json .TargetDir }},
+    {{ json .StatusFile }}
   )
 } catch (err) {
   console.log('error generating site', err)
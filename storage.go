@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/orcaman/concurrent-map"
+)
+
+// StorageBackend is where generated sites are stored and served from.
+// every site gets its own target, identified by the site domain. each
+// publish is stored as a new version inside the target and only starts
+// being served when it is activated, after it was fully uploaded.
+type StorageBackend interface {
+	// EnsureTarget creates the target for a domain if it doesn't exist
+	// and makes sure it is ready to be served.
+	EnsureTarget(domain string) error
+
+	// UploadTree stores every file under dirname as a new version of the
+	// target, keyed by their path relative to dirname. files with the same
+	// contents as in the live version are copied from there instead of
+	// being uploaded again.
+	UploadTree(domain, version, dirname string) (UploadResult, error)
+
+	// Activate makes a stored version the one being served. when it fails
+	// the previous one must still be served, or the error must say it
+	// isn't.
+	Activate(domain, version string) error
+
+	// Versions lists the versions stored in the target, in no particular
+	// order.
+	Versions(domain string) ([]string, error)
+
+	// ReadLive opens a file of the version being served.
+	ReadLive(domain, key string) (io.ReadCloser, error)
+
+	// RemoveVersion deletes a stored version.
+	RemoveVersion(domain, version string) error
+
+	// Targets lists the domains that have a target.
+	Targets() ([]string, error)
+
+	// MoveTarget moves the files of every version in a target to the
+	// target of another domain, serving there the same version, and
+	// leaves the first one empty.
+	MoveTarget(from, to string) error
+
+	// Redirect makes the target of from send every request to the same
+	// path on the domain to.
+	Redirect(from, to string) error
+
+	// RemoveTarget deletes the target and everything inside it.
+	RemoveTarget(domain string) error
+
+	// CNAMETarget is the hostname site domains must point to in order to
+	// be served from this backend.
+	CNAMETarget() string
+}
+
+// UploadResult describes what UploadTree did, compared to the live version.
+type UploadResult struct {
+	Keys      map[string]bool // every key in the new version
+	Bytes     int64           // total size of the files sent
+	Added     int
+	Changed   int
+	Unchanged int
+	Removed   int
+}
+
+func (r UploadResult) String() string {
+	return fmt.Sprintf("%d files added, %d changed, %d removed, %d unchanged.",
+		r.Added, r.Changed, r.Removed, r.Unchanged)
+}
+
+var storageBackend = os.Getenv("STORAGE_BACKEND")
+var sitesDir = os.Getenv("SITES_DIR")
+
+var storage StorageBackend = newStorage(storageBackend)
+
+func newStorage(kind string) StorageBackend {
+	switch kind {
+	case "local":
+		dir := sitesDir
+		if dir == "" {
+			dir = "sites"
+		}
+		return localStorage{dir: dir}
+	default:
+		return s3Storage{client: ms3}
+	}
+}
+
+// fileMD5 returns the hex md5 of a file, the same S3 uses as ETag for
+// objects uploaded in a single part.
+func fileMD5(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// keepVersions is how many versions of each site we keep for rollbacks,
+// not counting the live one if it is older than those.
+var keepVersions = envInt("KEEP_VERSIONS", 5)
+
+// pruneVersions removes all but the newest keepVersions versions of a site,
+// never touching the live one. versions are build ids, so newer is bigger.
+func pruneVersions(domain, live string) error {
+	versions, err := storage.Versions(domain)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		a, _ := strconv.Atoi(versions[i])
+		b, _ := strconv.Atoi(versions[j])
+		return a > b
+	})
+
+	for i, version := range versions {
+		if i < keepVersions || version == live {
+			continue
+		}
+		err = storage.RemoveVersion(domain, version)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activation of a site version, either after a publish or on a rollback,
+// must never happen twice at the same time for the same site.
+var activationLocks = cmap.New()
+
+func lockSiteActivation(domain string) func() {
+	activationLocks.SetIfAbsent(domain, &sync.Mutex{})
+	imu, _ := activationLocks.Get(domain)
+	mu := imu.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// lockSiteActivations locks two domains always in the same order, so two
+// renames between them can't wait on each other forever.
+func lockSiteActivations(a, b string) func() {
+	if b < a {
+		a, b = b, a
+	}
+	unlockA := lockSiteActivation(a)
+	unlockB := lockSiteActivation(b)
+	return func() {
+		unlockB()
+		unlockA()
+	}
+}
+
+func validDomain(domain string) error {
+	// a leading dot is also forbidden as we use those for internal names
+	if domain == "" || strings.HasPrefix(domain, ".") ||
+		strings.ContainsAny(domain, "/\\") {
+		return errors.New("invalid domain: " + domain)
+	}
+	return nil
+}
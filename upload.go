@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// files are uploaded by a pool of uploadConcurrency goroutines, each file
+// being tried up to uploadAttempts times, waiting longer after each failure.
+// a file that fails every time doesn't stop the others from being sent,
+// all failures are reported together at the end.
+
+var uploadConcurrency = envInt("UPLOAD_CONCURRENCY", 8)
+
+const uploadAttempts = 4
+
+var uploadFirstBackoff = 500 * time.Millisecond
+
+type treeFile struct {
+	key  string // path relative to the tree root, with forward slashes
+	path string
+	size int64
+}
+
+type uploadOutcome int
+
+const (
+	uploadAdded uploadOutcome = iota
+	uploadChanged
+	uploadUnchanged
+)
+
+// UploadError lists the keys that couldn't be uploaded after all attempts,
+// with the last error for each.
+type UploadError map[string]error
+
+func (e UploadError) Error() string {
+	keys := make([]string, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	failures := make([]string, len(keys))
+	for i, key := range keys {
+		failures[i] = key + " (" + e[key].Error() + ")"
+	}
+	return strconv.Itoa(len(keys)) + " files failed to upload: " +
+		strings.Join(failures, ", ")
+}
+
+func listTree(dirname string) (files []treeFile, err error) {
+	err = filepath.Walk(
+		dirname, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			key, _ := filepath.Rel(dirname, filename)
+			files = append(files, treeFile{
+				key:  filepath.ToSlash(key),
+				path: filename,
+				size: info.Size(),
+			})
+			return nil
+		})
+	return
+}
+
+// uploadTree calls upload for every file under dirname, which must decide
+// if the file needs to be sent, send it and say what it did.
+func uploadTree(dirname string, upload func(treeFile) (uploadOutcome, error)) (UploadResult, error) {
+	files, err := listTree(dirname)
+	if err != nil {
+		return UploadResult{Keys: make(map[string]bool)}, err
+	}
+	return uploadFiles(files, upload)
+}
+
+func uploadFiles(files []treeFile, upload func(treeFile) (uploadOutcome, error)) (UploadResult, error) {
+	result := UploadResult{Keys: make(map[string]bool)}
+
+	failures := make(UploadError)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan treeFile)
+
+	for i := 0; i < uploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				outcome, err := uploadWithRetry(file, upload)
+
+				mu.Lock()
+				if err != nil {
+					failures[file.key] = err
+				} else {
+					switch outcome {
+					case uploadAdded:
+						result.Added++
+						result.Bytes += file.size
+					case uploadChanged:
+						result.Changed++
+						result.Bytes += file.size
+					case uploadUnchanged:
+						result.Unchanged++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, file := range files {
+		result.Keys[file.key] = true
+		queue <- file
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return result, failures
+	}
+	return result, nil
+}
+
+func uploadWithRetry(file treeFile, upload func(treeFile) (uploadOutcome, error)) (outcome uploadOutcome, err error) {
+	backoff := uploadFirstBackoff
+	for attempt := 1; ; attempt++ {
+		outcome, err = upload(file)
+		if err == nil || attempt == uploadAttempts {
+			return
+		}
+
+		log.Debug().
+			Err(err).
+			Str("obj", file.key).
+			Int("attempt", attempt).
+			Msg("upload failed, will retry")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadFiles(t *testing.T) {
+	defer func(b time.Duration) { uploadFirstBackoff = b }(uploadFirstBackoff)
+	uploadFirstBackoff = time.Millisecond
+
+	files := []treeFile{
+		{key: "index.html", size: 10},
+		{key: "flaky.html", size: 20},
+		{key: "same.html", size: 30},
+		{key: "broken.html", size: 40},
+		{key: "img/broken.png", size: 50},
+	}
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	result, err := uploadFiles(files, func(file treeFile) (uploadOutcome, error) {
+		mu.Lock()
+		calls[file.key]++
+		n := calls[file.key]
+		mu.Unlock()
+
+		switch {
+		case file.key == "flaky.html" && n < uploadAttempts:
+			return 0, errors.New("timeout")
+		case file.key == "flaky.html":
+			return uploadChanged, nil
+		case file.key == "same.html":
+			return uploadUnchanged, nil
+		case strings.Contains(file.key, "broken"):
+			return 0, errors.New("refused " + strconv.Itoa(n))
+		}
+		return uploadAdded, nil
+	})
+
+	// failures don't stop the others
+	if result.Added != 1 || result.Changed != 1 || result.Unchanged != 1 || result.Bytes != 30 {
+		t.Errorf("result was %+v", result)
+	}
+	if len(result.Keys) != len(files) {
+		t.Errorf("keys were %v", result.Keys)
+	}
+
+	if calls["index.html"] != 1 || calls["flaky.html"] != uploadAttempts ||
+		calls["broken.html"] != uploadAttempts {
+		t.Errorf("uploads were tried %v times", calls)
+	}
+
+	uerr, ok := err.(UploadError)
+	if !ok {
+		t.Fatalf("error was %v", err)
+	}
+	if len(uerr) != 2 || uerr["broken.html"] == nil || uerr["img/broken.png"] == nil {
+		t.Errorf("failures were %v", uerr)
+	}
+	// with the error of the last attempt
+	if uerr["broken.html"].Error() != "refused 4" {
+		t.Errorf("broken.html failed with %s", uerr["broken.html"])
+	}
+	if !strings.HasPrefix(err.Error(), "2 files failed to upload: broken.html (") {
+		t.Errorf("error message was %s", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// files uploaded by users belong to a files:upload source and are kept in
+// uploadsDir/{site}/{source}/{upload id}, the uploads table has their
+// names. when publishing they are placed under the root of the source.
+
+var uploadsDir = func() string {
+	dir := os.Getenv("UPLOADS_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+	return dir
+}()
+
+var maxUploadSize = int64(envInt("UPLOAD_MAX_SIZE", 20<<20))
+
+// ErrNotUploadSource is returned when uploading to a source that doesn't
+// exist, isn't of the user or isn't a files:upload source.
+var ErrNotUploadSource = errors.New("not a files:upload source")
+
+type Upload struct {
+	Id        int       `db:"id" json:"id"`
+	Source    int       `db:"source" json:"source"`
+	Name      string    `db:"name" json:"name"`
+	Size      int64     `db:"size" json:"size"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+func siteUploadsDir(siteId int) string {
+	return filepath.Join(uploadsDir, strconv.Itoa(siteId))
+}
+
+func sourceUploadsDir(siteId, sourceId int) string {
+	return filepath.Join(siteUploadsDir(siteId), strconv.Itoa(sourceId))
+}
+
+func uploadFilename(siteId, sourceId, uploadId int) string {
+	return filepath.Join(sourceUploadsDir(siteId, sourceId), strconv.Itoa(uploadId))
+}
+
+// cleanUploadName makes name a path like "docs/a.pdf", which must not be
+// hidden or go outside the root of the source.
+func cleanUploadName(name string) (string, error) {
+	clean := path.Clean("/" + strings.Replace(name, "\\", "/", -1))[1:]
+	if clean == "" || strings.Contains(name, "..") || hiddenPath(clean) {
+		return "", errors.New("invalid file name: " + name)
+	}
+	return clean, nil
+}
+
+// saveUpload stores what is read from r as the file name of a source,
+// replacing the one with the same name if there is one.
+func saveUpload(pg *sqlx.DB, user string, sourceId int, name string, r io.Reader) (upload Upload, err error) {
+	name, err = cleanUploadName(name)
+	if err != nil {
+		return
+	}
+
+	// write it first so we know its size and don't have a row without file
+	err = os.MkdirAll(uploadsDir, 0755)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(uploadsDir, ".upload")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+
+	var siteId int
+	row := pg.QueryRowx(`
+INSERT INTO uploads (site, source, name, size)
+SELECT sources.site, sources.id, $3, $4 FROM sources
+INNER JOIN sites ON sources.site = sites.id
+WHERE sites.owner = $1 AND sources.id = $2 AND sources.provider = 'files:upload'
+ON CONFLICT (source, name) DO UPDATE SET size = excluded.size, created_at = now()
+RETURNING id, source, name, size, created_at, site
+    `, user, sourceId, name, size)
+	err = row.Scan(&upload.Id, &upload.Source, &upload.Name, &upload.Size,
+		&upload.CreatedAt, &siteId)
+	if err == sql.ErrNoRows {
+		err = ErrNotUploadSource
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	filename := uploadFilename(siteId, sourceId, upload.Id)
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), filename)
+	return
+}
+
+func listUploads(pg *sqlx.DB, user string, sourceId int) (uploads []Upload, err error) {
+	err = pg.Select(&uploads, `
+SELECT uploads.id, uploads.source, uploads.name, uploads.size, uploads.created_at
+FROM uploads
+INNER JOIN sites ON uploads.site = sites.id
+WHERE sites.owner = $1 AND uploads.source = $2
+ORDER BY uploads.name
+    `, user, sourceId)
+	return
+}
+
+func removeUpload(pg *sqlx.DB, user string, uploadId int) (err error) {
+	var target struct {
+		Site   int `db:"site"`
+		Source int `db:"source"`
+	}
+	err = pg.Get(&target, `
+DELETE FROM uploads
+WHERE id = $2 AND site IN (SELECT id FROM sites WHERE owner = $1)
+RETURNING site, source
+    `, user, uploadId)
+	if err != nil {
+		return
+	}
+
+	err = os.Remove(uploadFilename(target.Site, target.Source, uploadId))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// uploadProvider places the files uploaded to the source under its root.
+type uploadProvider struct{}
+
+func (p uploadProvider) Validate(data types.JSONText) FieldErrors {
+	return validateFields(nil, data)
+}
+
+// Paths doesn't include each file, as their names are only known after
+// looking at the uploads.
+func (p uploadProvider) Paths(root string, data types.JSONText) []string {
+	return []string{root}
+}
+
+func (p uploadProvider) Render(source Source) (pages []Page, files []File, err error) {
+	var uploads []Upload
+	err = pg.Select(&uploads, `
+SELECT id, source, name, size, created_at FROM uploads
+WHERE site = $1 AND source = $2
+ORDER BY name
+    `, source.Site, source.Id)
+	if err != nil {
+		return
+	}
+
+	root := normalizeRoot(source.Root)
+	for _, upload := range uploads {
+		data, err := ioutil.ReadFile(uploadFilename(source.Site, source.Id, upload.Id))
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, File{Path: root + upload.Name, Data: data})
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// field describes one key a provider expects in Source.Data.
+type field struct {
+	name     string
+	kind     string // string, url, int or bool
+	required bool
+}
+
+// FieldError says what is wrong with one field of a source.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// FieldErrors is what we return when a source is rejected.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	problems := make([]string, len(e))
+	for i, fe := range e {
+		problems[i] = fe.Field + " " + fe.Message
+	}
+	return "invalid source: " + strings.Join(problems, ", ")
+}
+
+// validateFields checks data against the fields a provider expects. keys
+// not listed are left alone.
+func validateFields(fields []field, data types.JSONText) (errs FieldErrors) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil || object == nil {
+		return FieldErrors{{"data", "must be an object"}}
+	}
+
+	for _, f := range fields {
+		value, ok := object[f.name]
+		if !ok || value == nil || value == "" {
+			if f.required {
+				errs = append(errs, FieldError{f.name, "is required"})
+			}
+			continue
+		}
+
+		switch f.kind {
+		case "string":
+			if _, ok := value.(string); !ok {
+				errs = append(errs, FieldError{f.name, "must be a string"})
+			}
+		case "url":
+			s, ok := value.(string)
+			if !ok || validateURL(s) != nil {
+				errs = append(errs, FieldError{f.name, "must be an http or https url"})
+			}
+		case "int":
+			n, ok := value.(float64)
+			if !ok || n != math.Trunc(n) || n < 1 {
+				errs = append(errs, FieldError{f.name, "must be a positive integer"})
+			}
+		case "bool":
+			if _, ok := value.(bool); !ok {
+				errs = append(errs, FieldError{f.name, "must be true or false"})
+			}
+		}
+	}
+	return
+}
+
+func writeFieldErrors(w http.ResponseWriter, errs FieldErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(struct {
+		Error  string      `json:"error"`
+		Fields FieldErrors `json:"fields"`
+	}{"invalid source", errs})
+}
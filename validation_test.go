@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+func fieldNames(errs FieldErrors) []string {
+	names := make([]string, len(errs))
+	for i, e := range errs {
+		names[i] = e.Field
+	}
+	return names
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestValidateFields(t *testing.T) {
+	fields := []field{
+		{"name", "string", true},
+		{"url", "url", false},
+		{"count", "int", false},
+		{"flag", "bool", false},
+	}
+
+	for _, test := range []struct {
+		data    string
+		invalid []string
+	}{
+		{`{"name": "x"}`, []string{}},
+		{`{"name": "x", "url": "https://example.com/", "count": 3, "flag": true}`, []string{}},
+		{`{"name": "x", "other": [1, 2]}`, []string{}},
+		{`{}`, []string{"name"}},
+		{`{"name": ""}`, []string{"name"}},
+		{`{"name": 1}`, []string{"name"}},
+		{`{"name": "x", "url": "file:///etc/passwd"}`, []string{"url"}},
+		{`{"name": "x", "url": "example.com"}`, []string{"url"}},
+		{`{"name": "x", "count": 1.5}`, []string{"count"}},
+		{`{"name": "x", "count": 0}`, []string{"count"}},
+		{`{"name": "x", "flag": "yes"}`, []string{"flag"}},
+		{`{"count": "3", "flag": 1}`, []string{"name", "count", "flag"}},
+		{`[]`, []string{"data"}},
+		{`null`, []string{"data"}},
+		{`not json`, []string{"data"}},
+	} {
+		errs := validateFields(fields, types.JSONText(test.data))
+		if names := fieldNames(errs); !sameNames(names, test.invalid) {
+			t.Errorf("%s: invalid fields are %v, not %v", test.data, names, test.invalid)
+		}
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	for _, test := range []struct {
+		source  Source
+		invalid []string
+	}{
+		{Source{Provider: "url:html", Data: types.JSONText(`{"url": "https://example.com/"}`)}, []string{}},
+		{Source{Provider: "url:html", Data: types.JSONText(`{}`)}, []string{"url"}},
+		{Source{Provider: "nothing", Data: types.JSONText(`{}`)}, []string{"provider"}},
+		{Source{Provider: "url:html", Data: types.JSONText(`{"url": "https://example.com/"}`), OnError: "skip"}, []string{}},
+		{Source{Provider: "url:html", Data: types.JSONText(`{"url": "https://example.com/"}`), OnError: "retry"}, []string{"on_error"}},
+		{Source{Provider: "trello:list", Data: types.JSONText(`{"apiKey": "k", "apiToken": "t", "id": "l"}`)}, []string{}},
+		{Source{Provider: "trello:list", Data: types.JSONText(`{"apiKey": "k"}`)}, []string{"apiToken", "id"}},
+		{Source{Provider: "git:repository", Data: types.JSONText(`{"url": "https://github.com/fiatjaf/sitios.git"}`)}, []string{}},
+		{Source{Provider: "git:repository", Data: types.JSONText(`{"url": "git@github.com:fiatjaf/sitios.git"}`)}, []string{}},
+		{Source{Provider: "git:repository", Data: types.JSONText(`{"url": "/app"}`)}, []string{"url"}},
+		{Source{Provider: "git:repository", Data: types.JSONText(`{"url": "file:///app"}`)}, []string{"url"}},
+		{Source{Provider: "git:repository", Data: types.JSONText(`{"url": "--upload-pack=touch /tmp/x"}`)}, []string{"url"}},
+		{Source{Provider: "git:repository", Data: types.JSONText(`{"url": "https://github.com/a/b", "branch": "-x"}`)}, []string{"branch"}},
+		{Source{Provider: "git:repository", Data: types.JSONText(`{"url": "https://github.com/a/b", "subdirectory": "../.."}`)}, []string{"subdirectory"}},
+	} {
+		errs := validateSource(test.source)
+		if names := fieldNames(errs); !sameNames(names, test.invalid) {
+			t.Errorf("%s %s: invalid fields are %v, not %v", test.source.Provider,
+				test.source.Data, names, test.invalid)
+		}
+	}
+}
+
+// sources given to /preview are not saved, so rendering checks them again
+func TestGitRenderRejectsLocalPaths(t *testing.T) {
+	_, _, err := gitProvider{}.Render(Source{
+		Root:     "/",
+		Provider: "git:repository",
+		Data:     types.JSONText(`{"url": "/app"}`),
+	})
+	if err == nil {
+		t.Error("rendered a repository from a local path")
+	}
+}